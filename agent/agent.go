@@ -2,20 +2,28 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"maps"
 	"os/exec"
-	"spysearch/log"
 	"spysearch/models"
 	"spysearch/tools"
+	"strings"
+	"time"
 )
 
 // this is an agent package
 type Agent struct {
-	Tools  []tools.Tool // a list of tool
-	Steps  int          // number of step allow the agent to run
-	Mmeory []string     // save the memory
-	Model  models.CompletionInterface // Exported for CLI access
-	WorkDir string      // Working directory for tool execution
+	Tools   []tools.Tool               // a list of tool
+	Steps   int                        // number of step allow the agent to run, 0 uses DefaultSteps
+	Plan    bool                       // ask the model for a plan before the first step
+	Budget  Budget                     // further limits of a run
+	Mmeory  []string                   // save the memory
+	Model   models.CompletionInterface // Exported for CLI access
+	WorkDir string                     // Working directory for tool execution
+	Usage   models.Usage               // tokens and cost of the current run
+
+	budget *runBudget
 }
 
 // all agent need a run function
@@ -26,12 +34,6 @@ type AgentInterface interface {
 // we call our agent spy agent
 type SpyAgent Agent
 
-type CodeReviewMsg struct {
-	Before string
-	After  string
-	Desc   string
-}
-
 // Helper to get a tool by name
 func (s *SpyAgent) getTool(name string) *tools.Tool {
 	for i, tool := range s.Tools {
@@ -42,136 +44,329 @@ func (s *SpyAgent) getTool(name string) *tools.Tool {
 	return nil
 }
 
+// bashWaitDelay is how long a cancelled bash command may keep its output open
+const bashWaitDelay = 500 * time.Millisecond
+
 // Helper to execute a tool with working directory support
-func (s *SpyAgent) executeTool(tool *tools.Tool, args map[string]any) (result tools.ToolExecutionResult, err error) {
-	// Pass workDir in args if tool supports it
+func (s *SpyAgent) executeTool(ctx context.Context, tool *tools.Tool, args map[string]any) (result tools.ToolExecutionResult, err error) {
+	// Pass workDir in a copy of args if tool supports it, events still hold the caller's map
 	if s.WorkDir != "" {
+		args = maps.Clone(args)
+		if args == nil {
+			args = map[string]any{}
+		}
 		args["workDir"] = s.WorkDir
 	}
-	return tool.Execute(args)
+	return tool.Execute(ctx, args)
+}
+
+// Start runs the agent on a user message, e.g. one with images attached, and
+// delivers its events on the returned channel, which is closed after RunFinished.
+// Every event is also written to log.json. The run streams the tokens and the
+// reasoning of the model and ends after Steps steps or when a limit of Budget is
+// reached. Cancelling ctx stops the model request or tool that is running
+func (s *SpyAgent) Start(ctx context.Context, task models.LLMMessage) <-chan Event {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		s.run(ctx, task, func(ev Event) { ch <- ev })
+	}()
+	return Tee(ch, LogEvent)
+}
+
+// RunWithCallback runs the agent on p and hands every event to onEvent, it returns when the run is over
+func (s *SpyAgent) RunWithCallback(ctx context.Context, p string, onEvent func(Event)) {
+	for ev := range s.Start(ctx, models.UserMessage(p)) {
+		onEvent(ev)
+	}
 }
 
-// Enhanced RunWithCallback: always use all tools, think before each step, log tool usage, limit to 5 steps, stream LLM (simulate)
-func (s *SpyAgent) RunWithCallback(p string, onStep func(interface{})) {
+func (s *SpyAgent) run(ctx context.Context, task models.LLMMessage, emit func(Event)) {
+	p := task.Content
+	if s.Budget.Time > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, s.Budget.Time, errTimeBudget)
+		defer cancel()
+	}
+	s.budget = &runBudget{Budget: s.Budget}
 	if s.Mmeory == nil {
 		s.Mmeory = []string{}
 	}
-	userMsg := p
-	maxSteps := 5
+	s.Usage = models.Usage{}
+	s.Model.SetSystemPrompt(SystemPrompt(s.WorkDir, s.Tools, s.Model.Capabilities()))
+	maxSteps := s.Steps
+	if maxSteps <= 0 {
+		maxSteps = DefaultSteps
+	}
+	emit(RunStarted{Task: p, Images: len(task.Images), Steps: maxSteps, Budget: s.Budget})
+
 	steps := 0
+	finish := func(f RunFinished) {
+		f.Steps, f.Usage = steps, s.Usage
+		emit(f)
+	}
+	// the task is pinned so trimming the history never drops it
+	task.Pinned = true
+	pending := []models.LLMMessage{task}
+	if s.Plan {
+		plan, err := s.plan(ctx, task, emit)
+		if err != nil {
+			if ctx.Err() != nil {
+				finish(s.interrupted(ctx))
+			} else {
+				emit(NewError("model", err))
+				finish(RunFinished{Reason: FinishError})
+			}
+			return
+		}
+		// the task is in the history already, the plan is repeated in a pinned
+		// message since the reply it came in may be trimmed
+		pending = []models.LLMMessage{{Role: "user", Content: carryOutPrompt + "\n" + plan, Pinned: true}}
+	}
 	for steps < maxSteps {
+		if ctx.Err() != nil {
+			finish(s.interrupted(ctx))
+			return
+		}
+		// usage is checked before every request
+		if exceeded := s.budget.check(s.Usage); exceeded != nil {
+			finish(RunFinished{Reason: FinishBudget, Budget: exceeded})
+			return
+		}
 		steps++
-		// 1. Think before acting
-		thinkingTool := s.getTool("thinking")
-		if thinkingTool != nil {
-			thought, _ := thinkingTool.Execute(map[string]any{
-				"thinkingstep": steps,
-				"rethink":      false,
-				"content":      fmt.Sprintf("Step %d: Considering next action for: %s", steps, userMsg),
-				"summary":      "",
-			})
-			onStep("[THINKING] " + thought.Result)
-			log.LogToolCall("thinking", map[string]any{
-				"thinkingstep": steps,
-				"rethink":      false,
-				"content":      fmt.Sprintf("Step %d: Considering next action for: %s", steps, userMsg),
-				"summary":      "",
-			}, thought.Result)
-		}
-
-		// 2. Send to LLM (simulate streaming by splitting response)
-		resp, err := s.Model.Completion(userMsg, s.Tools)
+		// Send to LLM, streaming tokens when the client supports it
+		resp, err := s.complete(ctx, steps, pending, emit)
+		if ctx.Err() != nil {
+			finish(s.interrupted(ctx))
+			return
+		}
 		if err != nil {
-			onStep("[Agent Error] " + err.Error())
-			log.LogEvent("agent_error", err.Error())
+			emit(NewError("model", err))
+			finish(RunFinished{Reason: FinishError})
 			return
 		}
 		s.Mmeory = append(s.Mmeory, "[LLM] "+resp.Content)
-		log.LogEvent("llm_response", resp.Content)
-		// Simulate streaming by word
-		for _, word := range bytes.Split([]byte(resp.Content), []byte(" ")) {
-			onStep("[LLM] " + string(word))
+		emit(ModelReply{Step: steps, Content: resp.Content, Reasoning: resp.Thinking, ToolCalls: resp.ToolCalls})
+		if resp.Usage != nil {
+			s.Usage.Add(*resp.Usage)
+			// the CLI adds it to the status bar
+			emit(UsageUpdated{Usage: *resp.Usage, Total: s.Usage})
 		}
 
+		// Native tool calls are answered with tool messages linked to the call id
+		if len(resp.ToolCalls) > 0 {
+			pending = []models.LLMMessage{}
+			for _, call := range resp.ToolCalls {
+				if call.Function.ArgumentsError != "" {
+					result := s.rejectToolCall(steps, call.ID, call.ToolResponse(), call.Function.ArgumentsError, emit)
+					pending = append(pending, models.ToolMessage(call, result))
+					continue
+				}
+				result, finished := s.handleToolCall(ctx, steps, call.ID, call.ToolResponse(), emit)
+				if finished != nil {
+					finish(*finished)
+					return
+				}
+				pending = append(pending, models.ToolMessage(call, result))
+			}
+			continue
+		}
+
+		// Fallback for models without native tool support: ```json block in the content
 		toolResp, err := tools.ExtractResponse(resp.Content)
 		if err != nil || toolResp == nil {
-			onStep("[Agent Final]: " + resp.Content)
-			log.LogEvent("agent_final", resp.Content)
+			finish(RunFinished{Reason: FinishAnswer, Result: resp.Content})
 			return
 		}
-
-		tool := s.getTool(toolResp.Name)
-		if tool == nil {
-			onStep("[Agent] Tool not found: " + toolResp.Name)
-			log.LogEvent("tool_not_found", toolResp.Name)
+		if toolResp.Arguments == nil {
+			toolResp.Arguments = map[string]any{}
+		}
+		result, finished := s.handleToolCall(ctx, steps, "", toolResp, emit)
+		if finished != nil {
+			finish(*finished)
 			return
 		}
-		// Always show which tool is being used
-		onStep(fmt.Sprintf("[USING TOOL] %s", tool.ToolFunction.Name))
-		log.LogEvent("using_tool", tool.ToolFunction.Name)
+		pending = []models.LLMMessage{models.FencedToolResult(result)}
+	}
+	finish(RunFinished{Reason: FinishStepLimit})
+}
 
-		// Special handling for bash: capture output and set working directory
-		if tool.ToolFunction.Name == "bash" {
-			cmdStr, _ := toolResp.Arguments["command"].(string)
-			cmd := exec.Command("bash", "-c", cmdStr)
-			if s.WorkDir != "" {
-				cmd.Dir = s.WorkDir
-			}
-			var out bytes.Buffer
-			cmd.Stdout = &out
-			cmd.Stderr = &out
-			err := cmd.Run()
-			result := out.String()
-			if err != nil {
-				result += "\n[Error] " + err.Error()
-			}
-			onStep("[BASH OUTPUT] " + result)
-			log.LogToolCall("bash", toolResp.Arguments, result)
-			s.Mmeory = append(s.Mmeory, "[Tool bash]: "+result)
-			userMsg = result
-			continue
-		}
+// interrupted ends a run whose context is done, cancelled by the user unless
+// the time budget ran out
+func (s *SpyAgent) interrupted(ctx context.Context) RunFinished {
+	if context.Cause(ctx) != errTimeBudget {
+		return RunFinished{Reason: FinishCancelled}
+	}
+	return RunFinished{Reason: FinishBudget, Budget: &BudgetExceeded{Limit: "time", Used: s.Budget.Time.String(), Max: s.Budget.Time.String()}}
+}
+
+var planPrompt = `Before doing anything, think about the task above and write a short plan: what you need to find out, the tools you will use and how you will know you are done. Do not call any tool yet.`
+
+var carryOutPrompt = `Carry out your plan step by step with the tools. Your plan:`
+
+// plan asks the model how it will solve task, without tools, and shows the
+// answer as the reasoning of step 0. A Router sends it to its thinking backend
+func (s *SpyAgent) plan(ctx context.Context, task models.LLMMessage, emit func(Event)) (string, error) {
+	msg := task
+	msg.Content += "\n\n" + planPrompt
+	resp, err := s.Model.Chat(models.WithTask(ctx, models.TaskThinking), []models.LLMMessage{msg}, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.Thinking != "" {
+		emit(ReasoningDelta{Content: resp.Thinking + "\n\n"})
+	}
+	emit(ReasoningDelta{Content: resp.Content})
+	emit(ModelReply{Content: resp.Content, Reasoning: resp.Thinking})
+	s.Mmeory = append(s.Mmeory, "[Plan] "+resp.Content)
+	if resp.Usage != nil {
+		s.Usage.Add(*resp.Usage)
+		emit(UsageUpdated{Usage: *resp.Usage, Total: s.Usage})
+	}
+	return resp.Content, nil
+}
 
-		// Modifier tool: show diff and ask for approval
-		if tool.ToolFunction.Name == "modifier" {
-			before := ""
-			if v, ok := toolResp.Arguments["input"].(string); ok {
-				before = v
+// complete sends msgs to the model, every streamed token is a ModelDelta and
+// every piece of reasoning a ReasoningDelta. Tools are only sent to models that
+// can call them, the others read them in the system prompt
+func (s *SpyAgent) complete(ctx context.Context, step int, msgs []models.LLMMessage, emit func(Event)) (models.LLMMessage, error) {
+	caps := s.Model.Capabilities()
+	toolList := s.Tools
+	if !caps.NativeTools {
+		toolList = nil
+	}
+	if stream, ok := s.Model.(models.StreamingCompletion); ok && caps.Streaming {
+		return stream.ChatStream(ctx, msgs, toolList, func(chunk models.StreamChunk) {
+			if chunk.Thinking != "" {
+				emit(ReasoningDelta{Step: step, Content: chunk.Thinking})
 			}
-			result, err := s.executeTool(tool, toolResp.Arguments)
-			if err != nil {
-				onStep("[Tool Error] " + err.Error())
-				log.LogToolCall("modifier", toolResp.Arguments, err.Error())
-				return
+			if chunk.Content != "" {
+				emit(ModelDelta{Step: step, Content: chunk.Content})
 			}
-			onStep(CodeReviewMsg{
-				Before: before,
-				After:  result.Result,
-				Desc:   "Modifier tool result. Accept, edit, or decline?",
-			})
-			log.LogToolCall("modifier", toolResp.Arguments, result.Result)
-			// Wait for user input (accept/edit/decline) - handled in CLI
-			return
+		})
+	}
+	resp, err := s.Model.Chat(ctx, msgs, toolList)
+	if err == nil && resp.Thinking != "" {
+		emit(ReasoningDelta{Step: step, Content: resp.Thinking})
+	}
+	if err == nil && resp.Content != "" {
+		emit(ModelDelta{Step: step, Content: resp.Content})
+	}
+	return resp, err
+}
+
+// approvalResult tells the model what the user did with the result of a tool
+func approvalResult(a Approval, result string) string {
+	switch a.Decision {
+	case Edit:
+		return "The user edited the result, continue with this version:\n" + a.Text
+	case Decline:
+		return "The user declined the change, it was not applied. Try another approach or ask what they want."
+	default:
+		return "The user accepted the change:\n" + result
+	}
+}
+
+// rejectToolCall reports a call that cannot run, e.g. of an unknown tool, as
+// its failed result. The model gets the error back and can correct the call
+func (s *SpyAgent) rejectToolCall(step int, id string, toolResp *tools.ToolResponse, reason string, emit func(Event)) string {
+	emit(ToolCallFinished{Step: step, ID: id, Name: toolResp.Name, Arguments: maps.Clone(toolResp.Arguments), Error: reason})
+	s.Mmeory = append(s.Mmeory, fmt.Sprintf("[Tool %s]: %s", toolResp.Name, reason))
+	return "Error: " + reason
+}
+
+// handleToolCall runs a single tool call and returns its result, finished is set when the run is over
+func (s *SpyAgent) handleToolCall(ctx context.Context, step int, id string, toolResp *tools.ToolResponse, emit func(Event)) (string, *RunFinished) {
+	tool := s.getTool(toolResp.Name)
+	if tool == nil {
+		names := []string{}
+		for _, t := range s.Tools {
+			names = append(names, t.ToolFunction.Name)
 		}
+		reason := fmt.Sprintf("there is no tool named %q, the tools are: %s", toolResp.Name, strings.Join(names, ", "))
+		return s.rejectToolCall(step, id, toolResp, reason, emit), nil
+	}
+	if tool.ToolFunction.Name == "bash" {
+		if exceeded := s.budget.bash(); exceeded != nil {
+			return "", &RunFinished{Reason: FinishBudget, Budget: exceeded}
+		}
+	}
+	name := tool.ToolFunction.Name
+	// events are read on other goroutines, each gets its own copy of the arguments
+	emit(ToolCallStarted{Step: step, ID: id, Name: name, Arguments: maps.Clone(toolResp.Arguments)})
+	finished := ToolCallFinished{Step: step, ID: id, Name: name, Arguments: maps.Clone(toolResp.Arguments)}
 
-		// Normal tool execution
-		result, err := s.executeTool(tool, toolResp.Arguments)
+	// Special handling for bash: capture output and set working directory
+	if name == "bash" {
+		cmdStr, _ := toolResp.Arguments["command"].(string)
+		cmd := exec.CommandContext(ctx, "bash", "-c", cmdStr)
+		// a cancelled run must not wait for background children of the command
+		killGroupOnCancel(cmd)
+		cmd.WaitDelay = bashWaitDelay
+		if s.WorkDir != "" {
+			cmd.Dir = s.WorkDir
+		}
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		result := out.String()
 		if err != nil {
-			onStep("[Tool Error] " + err.Error())
-			log.LogToolCall(tool.ToolFunction.Name, toolResp.Arguments, err.Error())
+			result += "\n[Error] " + err.Error()
 		}
-		onStep(fmt.Sprintf("[TOOL %s RESULT] %s", tool.ToolFunction.Name, result.Result))
-		log.LogToolCall(tool.ToolFunction.Name, toolResp.Arguments, result.Result)
-		s.Mmeory = append(s.Mmeory, fmt.Sprintf("[Tool %s]: %s", tool.ToolFunction.Name, result.Result))
+		finished.Result = result
+		emit(finished)
+		s.Mmeory = append(s.Mmeory, "[Tool bash]: "+result)
+		return result, nil
+	}
 
-		if tool.ToolFunction.Name == "done" {
-			onStep("[Agent Done]: " + result.Result)
-			log.LogEvent("agent_done", result.Result)
-			return
+	// Modifier tool: show diff and ask for approval
+	if name == "modifier" {
+		before := ""
+		if v, ok := toolResp.Arguments["input"].(string); ok {
+			before = v
+		}
+		result, err := s.executeTool(ctx, tool, toolResp.Arguments)
+		if err != nil {
+			finished.Error = err.Error()
+			emit(finished)
+			emit(NewError("tool", err))
+			return "", &RunFinished{Reason: FinishError}
 		}
+		reply := make(chan Approval, 1)
+		emit(ApprovalRequested{
+			ID:     id,
+			Tool:   name,
+			Before: before,
+			After:  result.Result,
+			Desc:   "Modifier tool result. Accept, edit, or decline?",
+			Reply:  reply,
+		})
+		// the user's decision is what the model gets back
+		var approval Approval
+		select {
+		case approval = <-reply:
+		case <-ctx.Done():
+			end := s.interrupted(ctx)
+			return "", &end
+		}
+		finished.Result = approvalResult(approval, result.Result)
+		emit(finished)
+		s.Mmeory = append(s.Mmeory, "[Tool modifier]: "+finished.Result)
+		return finished.Result, nil
+	}
+
+	// Normal tool execution
+	result, err := s.executeTool(ctx, tool, toolResp.Arguments)
+	finished.Result = result.Result
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	emit(finished)
+	s.Mmeory = append(s.Mmeory, fmt.Sprintf("[Tool %s]: %s", name, result.Result))
 
-		userMsg = result.Result
+	if name == "done" {
+		return result.Result, &RunFinished{Reason: FinishDone, Result: result.Result}
 	}
-	onStep("[Agent] Step limit reached.")
-	log.LogEvent("step_limit_reached", nil)
+	return result.Result, nil
 }
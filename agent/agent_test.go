@@ -0,0 +1,381 @@
+package agent_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"spysearch/agent"
+	"spysearch/models"
+	"spysearch/tools"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run drives the agent with a scripted model and returns the RunFinished event
+func run(t *testing.T, model *models.ScriptedClient, prompt string) (*agent.SpyAgent, agent.RunFinished) {
+	return runLimited(t, model, prompt, 0, agent.Budget{})
+}
+
+func runLimited(t *testing.T, model *models.ScriptedClient, prompt string, steps int, budget agent.Budget) (*agent.SpyAgent, agent.RunFinished) {
+	t.Setenv("HOME", t.TempDir())
+	ag := &agent.SpyAgent{
+		Tools: []tools.Tool{
+			tools.NewDoneTool().Tool,
+			tools.NewBashTool().Tool,
+		},
+		Steps:   steps,
+		Budget:  budget,
+		Model:   model,
+		WorkDir: t.TempDir(),
+	}
+	events := []agent.Event{}
+	ag.RunWithCallback(context.Background(), prompt, func(ev agent.Event) {
+		events = append(events, ev)
+	})
+	if _, ok := events[0].(agent.RunStarted); !ok {
+		t.Fatalf("expected RunStarted first, got %#v", events[0])
+	}
+	finished, ok := events[len(events)-1].(agent.RunFinished)
+	if !ok {
+		t.Fatalf("expected RunFinished last, got %#v", events[len(events)-1])
+	}
+	return ag, finished
+}
+
+func TestAgentRunsToolsUntilDone(t *testing.T) {
+	model := models.NewScriptedClient(
+		models.ToolCallMessage("bash", map[string]any{"command": "echo hello > out.txt && cat out.txt"}),
+		models.ToolCallMessage("done", map[string]any{"message": "created out.txt"}),
+	)
+	ag, finished := run(t, model, "create out.txt")
+
+	data, err := os.ReadFile(filepath.Join(ag.WorkDir, "out.txt"))
+	if err != nil || strings.TrimSpace(string(data)) != "hello" {
+		t.Fatalf("bash did not run in the work dir: %q, %v", data, err)
+	}
+	if finished.Reason != agent.FinishDone || finished.Result != "created out.txt" || finished.Steps != 2 {
+		t.Errorf("unexpected end of run %+v", finished)
+	}
+
+	// the bash output goes back as a tool message linked to the call
+	if len(model.Requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(model.Requests))
+	}
+	second := model.Requests[1]
+	call, result := second[len(second)-2], second[len(second)-1]
+	if result.Role != "tool" || result.ToolCallID != call.ToolCalls[0].ID || !strings.Contains(result.Content, "hello") {
+		t.Errorf("unexpected tool result %+v for call %+v", result, call)
+	}
+	if second[0].Role != "system" || !strings.Contains(second[0].Content, ag.WorkDir) {
+		t.Errorf("expected the agent system prompt first, got %+v", second[0])
+	}
+}
+
+func TestAgentFencedToolCallFallback(t *testing.T) {
+	model := models.NewScriptedClient(
+		models.AssistantMessage("```json\n{\"name\": \"done\", \"arguments\": {\"message\": \"nothing to do\"}}\n```"),
+	)
+	_, finished := run(t, model, "do nothing")
+	if finished.Reason != agent.FinishDone || finished.Result != "nothing to do" {
+		t.Errorf("unexpected end of run %+v", finished)
+	}
+}
+
+func TestAgentFinalAnswer(t *testing.T) {
+	model := models.NewScriptedClient(models.AssistantMessage("Go is a programming language."))
+	_, finished := run(t, model, "what is go?")
+	if finished.Reason != agent.FinishAnswer || finished.Result != "Go is a programming language." {
+		t.Errorf("unexpected end of run %+v", finished)
+	}
+}
+
+func bashCalls(n int) []models.LLMMessage {
+	replies := []models.LLMMessage{}
+	for i := 0; i < n; i++ {
+		replies = append(replies, models.ToolCallMessage("bash", map[string]any{"command": "true"}))
+	}
+	return replies
+}
+
+func TestAgentHonoursSteps(t *testing.T) {
+	model := models.NewScriptedClient(bashCalls(10)...)
+	_, finished := runLimited(t, model, "loop", 7, agent.Budget{})
+	if len(model.Requests) != 7 || finished.Reason != agent.FinishStepLimit {
+		t.Errorf("expected 7 requests and the step limit, got %d: %+v", len(model.Requests), finished)
+	}
+}
+
+func TestAgentBudgets(t *testing.T) {
+	expensive := bashCalls(10)
+	for i := range expensive {
+		expensive[i].Usage = &models.Usage{TotalTokens: 400}
+	}
+	cases := []struct {
+		name     string
+		replies  []models.LLMMessage
+		budget   agent.Budget
+		requests int
+		want     string
+	}{
+		{"bash calls", bashCalls(10), agent.Budget{BashCalls: 2}, 3, "bash calls (2 of 2)"},
+		{"tokens", expensive, agent.Budget{Tokens: 1000}, 3, "tokens (1200 of 1000)"},
+	}
+	for _, c := range cases {
+		model := models.NewScriptedClient(c.replies...)
+		_, finished := runLimited(t, model, "loop", 10, c.budget)
+		if len(model.Requests) != c.requests || finished.Reason != agent.FinishBudget || finished.Budget.String() != c.want {
+			t.Errorf("%s: expected %d requests ending with %q, got %d: %+v", c.name, c.requests, c.want, len(model.Requests), finished)
+		}
+	}
+}
+
+func TestAgentEventStream(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ag := &agent.SpyAgent{
+		Tools: []tools.Tool{tools.NewDoneTool().Tool, tools.NewBashTool().Tool},
+		Model: models.NewScriptedClient(
+			models.ToolCallMessage("bash", map[string]any{"command": "echo hi"}),
+			models.ToolCallMessage("done", map[string]any{"message": "said hi"}),
+		),
+		WorkDir: t.TempDir(),
+	}
+	kinds := []string{}
+	var bash, done agent.ToolCallFinished
+	for ev := range ag.Start(context.Background(), models.UserMessage("say hi")) {
+		kinds = append(kinds, ev.Kind())
+		if f, ok := ev.(agent.ToolCallFinished); ok && f.Name == "bash" {
+			bash = f
+		}
+		if f, ok := ev.(agent.ToolCallFinished); ok && f.Name == "done" {
+			done = f
+		}
+	}
+	// the work dir is added for the tool only, not to the arguments of the model
+	if _, ok := done.Arguments["workDir"]; ok || done.Arguments["message"] != "said hi" {
+		t.Errorf("unexpected done arguments %v", done.Arguments)
+	}
+	want := "run_started model_reply tool_call_started tool_call_finished model_reply tool_call_started tool_call_finished run_finished"
+	if strings.Join(kinds, " ") != want {
+		t.Errorf("unexpected events:\n%s\nwant\n%s", strings.Join(kinds, " "), want)
+	}
+	if bash.Step != 1 || bash.ID == "" || strings.TrimSpace(bash.Result) != "hi" || bash.Arguments["command"] != "echo hi" {
+		t.Errorf("unexpected bash event %+v", bash)
+	}
+}
+
+func TestAgentResumesAfterApproval(t *testing.T) {
+	modify := models.ToolCallMessage("modifier", map[string]any{
+		"operation": "replace", "input": "x := 1", "target": "1", "replacement": "2",
+	})
+	cases := []struct {
+		approval agent.Approval
+		want     string
+	}{
+		{agent.Approval{Decision: agent.Accept}, "accepted the change:\nx := 2"},
+		{agent.Approval{Decision: agent.Edit, Text: "x := 3"}, "edited the result, continue with this version:\nx := 3"},
+		{agent.Approval{Decision: agent.Decline}, "declined the change"},
+	}
+	for _, c := range cases {
+		t.Setenv("HOME", t.TempDir())
+		model := models.NewScriptedClient(modify, models.ToolCallMessage("done", map[string]any{"message": "ok"}))
+		ag := &agent.SpyAgent{
+			Tools:   []tools.Tool{tools.NewDoneTool().Tool, tools.NewModifierTool().Tool},
+			Model:   model,
+			WorkDir: t.TempDir(),
+		}
+		var last agent.Event
+		for ev := range ag.Start(context.Background(), models.UserMessage("bump x")) {
+			if req, ok := ev.(agent.ApprovalRequested); ok {
+				if req.Before != "x := 1" || req.After != "x := 2" {
+					t.Errorf("unexpected change %q -> %q", req.Before, req.After)
+				}
+				req.Reply <- c.approval
+			}
+			last = ev
+		}
+		if f, ok := last.(agent.RunFinished); !ok || f.Reason != agent.FinishDone {
+			t.Errorf("expected the run to go on until done, got %#v", last)
+		}
+		if len(model.Requests) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(model.Requests))
+		}
+		second := model.Requests[1]
+		if result := second[len(second)-1]; result.Role != "tool" || !strings.Contains(result.Content, c.want) {
+			t.Errorf("expected the decision %q as tool result, got %+v", c.want, result)
+		}
+	}
+}
+
+func TestAgentCancelledWhileWaitingForApproval(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ag := &agent.SpyAgent{
+		Tools: []tools.Tool{tools.NewModifierTool().Tool},
+		Model: models.NewScriptedClient(models.ToolCallMessage("modifier", map[string]any{"operation": "view", "input": "x"})),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last agent.Event
+	for ev := range ag.Start(ctx, models.UserMessage("look at x")) {
+		if _, ok := ev.(agent.ApprovalRequested); ok {
+			cancel()
+		}
+		last = ev
+	}
+	if f, ok := last.(agent.RunFinished); !ok || f.Reason != agent.FinishCancelled {
+		t.Errorf("expected a cancelled run, got %#v", last)
+	}
+}
+
+func TestAgentThinksOnlyWhenTheModelDoes(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ag := &agent.SpyAgent{
+		Tools: []tools.Tool{tools.NewDoneTool().Tool, tools.NewThinkingTool().Tool},
+		Model: models.NewScriptedClient(
+			models.ToolCallMessage("thinking", map[string]any{"content": "nothing to change, I can stop"}),
+			models.ToolCallMessage("done", map[string]any{"message": "nothing to do"}),
+		),
+		WorkDir: t.TempDir(),
+	}
+	thoughts := []string{}
+	ag.RunWithCallback(context.Background(), "tidy up", func(ev agent.Event) {
+		if f, ok := ev.(agent.ToolCallFinished); ok && f.Name == "thinking" {
+			thoughts = append(thoughts, f.Result)
+		}
+	})
+	if len(thoughts) != 1 || thoughts[0] != "nothing to change, I can stop" {
+		t.Errorf("expected only the thought of the model, got %q", thoughts)
+	}
+}
+
+func TestAgentPlanAndReasoning(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	plan := models.AssistantMessage("1. say hi 2. call done")
+	reply := models.AssistantMessage("hi")
+	reply.Thinking = "the plan says hi"
+	model := models.NewScriptedClient(plan, reply)
+	ag := &agent.SpyAgent{Tools: []tools.Tool{tools.NewDoneTool().Tool}, Plan: true, Model: model, WorkDir: t.TempDir()}
+
+	reasoning := map[int]string{}
+	var final agent.ModelReply
+	ag.RunWithCallback(context.Background(), "say hi", func(ev agent.Event) {
+		switch v := ev.(type) {
+		case agent.ReasoningDelta:
+			reasoning[v.Step] += v.Content
+		case agent.ModelReply:
+			final = v
+		}
+	})
+	if len(model.Requests) != 2 {
+		t.Fatalf("expected a planning request and a step, got %d requests", len(model.Requests))
+	}
+	// the plan is asked for first and stays in the history of the step
+	if !strings.Contains(model.Requests[0][1].Content, "plan") || model.Requests[1][2].Content != "1. say hi 2. call done" {
+		t.Errorf("unexpected requests %+v", model.Requests)
+	}
+	if reasoning[0] != "1. say hi 2. call done" || reasoning[1] != "the plan says hi" {
+		t.Errorf("unexpected reasoning %q", reasoning)
+	}
+	if final.Step != 1 || final.Reasoning != "the plan says hi" {
+		t.Errorf("unexpected reply %+v", final)
+	}
+}
+
+func TestAgentKeepsTaskWhenTrimming(t *testing.T) {
+	fenced := models.AssistantMessage("```json\n{\"name\": \"bash\", \"arguments\": {\"command\": \"seq 2000\"}}\n```")
+	model := models.NewScriptedClient(fenced, fenced, fenced, models.AssistantMessage("counted"))
+	model.Context = models.ContextPolicy{Budget: 300, MaxToolOutput: 100}
+	_, finished := run(t, model, "count to 2000 three times")
+	if finished.Reason != agent.FinishAnswer {
+		t.Fatalf("unexpected end of run %+v", finished)
+	}
+	last := model.Requests[len(model.Requests)-1]
+	if last[1].Content != "count to 2000 three times" {
+		t.Errorf("the task was dropped: %+v", last[1])
+	}
+	for _, m := range last {
+		if len(m.Content) > 1000 && m.Role != "system" {
+			t.Errorf("fenced tool result was not truncated: %d chars", len(m.Content))
+		}
+	}
+}
+
+// cancelOn starts ag and cancels it once ready sees the event it waits for,
+// it returns the last event and how long the run took to end after the cancel
+func cancelOn(t *testing.T, ag *agent.SpyAgent, ready func(agent.Event) bool) (agent.Event, time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last agent.Event
+	var cancelled time.Time
+	for ev := range ag.Start(ctx, models.UserMessage("wait")) {
+		if cancelled.IsZero() && ready(ev) {
+			// let the tool or request get going
+			time.Sleep(200 * time.Millisecond)
+			cancelled = time.Now()
+			cancel()
+		}
+		last = ev
+	}
+	return last, time.Since(cancelled)
+}
+
+func TestAgentCancelDuringBash(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ag := &agent.SpyAgent{
+		Tools:   []tools.Tool{tools.NewBashTool().Tool},
+		Model:   models.NewScriptedClient(models.ToolCallMessage("bash", map[string]any{"command": "sleep 5; echo done"})),
+		WorkDir: t.TempDir(),
+	}
+	last, took := cancelOn(t, ag, func(ev agent.Event) bool {
+		_, ok := ev.(agent.ToolCallStarted)
+		return ok
+	})
+	if f, ok := last.(agent.RunFinished); !ok || f.Reason != agent.FinishCancelled || took > 2*time.Second {
+		t.Errorf("expected a prompt cancel, got %#v after %s", last, took)
+	}
+}
+
+func TestAgentCancelDuringModelRequest(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	ag := &agent.SpyAgent{
+		Model:   models.NewLLMFromConfig(models.Config{Provider: "openai-compatible", Model: "slow", BaseURL: server.URL}),
+		WorkDir: t.TempDir(),
+	}
+	last, took := cancelOn(t, ag, func(ev agent.Event) bool {
+		_, ok := ev.(agent.RunStarted)
+		return ok
+	})
+	if f, ok := last.(agent.RunFinished); !ok || f.Reason != agent.FinishCancelled || took > 2*time.Second {
+		t.Errorf("expected a prompt cancel, got %#v after %s", last, took)
+	}
+}
+
+func TestAgentReportsBadToolCalls(t *testing.T) {
+	malformed := models.ToolCallMessage("bash", map[string]any{})
+	malformed.ToolCalls[0].Function.ArgumentsError = "invalid arguments {\"command\": "
+	model := models.NewScriptedClient(
+		models.ToolCallMessage("grep", map[string]any{"pattern": "x"}),
+		malformed,
+		models.ToolCallMessage("done", map[string]any{"message": "fixed"}),
+	)
+	_, finished := run(t, model, "find x")
+	if finished.Reason != agent.FinishDone || len(model.Requests) != 3 {
+		t.Fatalf("expected the run to go on after bad calls, got %+v after %d requests", finished, len(model.Requests))
+	}
+	// each error goes back to the model as the result of its call
+	for i, want := range []string{`no tool named "grep"`, "invalid arguments"} {
+		result := model.Requests[i+1][len(model.Requests[i+1])-1]
+		if result.Role != "tool" || !strings.Contains(result.Content, want) {
+			t.Errorf("expected %q in the result, got %+v", want, result)
+		}
+	}
+}
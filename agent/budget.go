@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"spysearch/models"
+	"time"
+)
+
+// DefaultSteps is the step limit of an agent whose Steps is not set
+const DefaultSteps = 5
+
+// Budget limits a run besides the number of steps, zero fields are unlimited
+type Budget struct {
+	Time      time.Duration // wall clock
+	Tokens    int           // prompt and completion tokens of every request
+	BashCalls int
+	Cost      float64 // USD, only known for models with a price
+}
+
+// BudgetExceeded reports the limit that ended a run
+type BudgetExceeded struct {
+	Limit string `json:"limit"` // time, tokens, bash calls or cost
+	Used  string `json:"used"`
+	Max   string `json:"max"`
+}
+
+func (b BudgetExceeded) String() string {
+	return fmt.Sprintf("%s (%s of %s)", b.Limit, b.Used, b.Max)
+}
+
+var errTimeBudget = errors.New("time budget exceeded")
+
+// runBudget keeps what a run has used so far, time is enforced by the run context
+type runBudget struct {
+	Budget
+	bashCalls int
+}
+
+// check returns the first limit usage has reached
+func (r *runBudget) check(usage models.Usage) *BudgetExceeded {
+	if r.Tokens > 0 && usage.TotalTokens >= r.Tokens {
+		return &BudgetExceeded{Limit: "tokens", Used: fmt.Sprint(usage.TotalTokens), Max: fmt.Sprint(r.Tokens)}
+	}
+	if r.Cost > 0 && usage.Cost >= r.Cost {
+		return &BudgetExceeded{Limit: "cost", Used: fmt.Sprintf("$%.4f", usage.Cost), Max: fmt.Sprintf("$%.4f", r.Cost)}
+	}
+	return nil
+}
+
+// bash counts a bash call, it fails when the call would go over the limit
+func (r *runBudget) bash() *BudgetExceeded {
+	if r.BashCalls > 0 && r.bashCalls >= r.BashCalls {
+		return &BudgetExceeded{Limit: "bash calls", Used: fmt.Sprint(r.bashCalls), Max: fmt.Sprint(r.BashCalls)}
+	}
+	r.bashCalls++
+	return nil
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"spysearch/log"
+	"spysearch/models"
+	"strings"
+	"sync"
+)
+
+// Debater is one participant of a debate, Model keeps its history so every
+// debater needs a client of its own
+type Debater struct {
+	Name  string
+	Model models.CompletionInterface
+}
+
+// Debate lets Debaters propose answers to a prompt and critique each other for
+// Rounds rounds, then the Judge synthesizes the final answer
+type Debate struct {
+	Debaters []Debater
+	Judge    Debater
+	Rounds   int // critique rounds after the opening answers
+}
+
+// DebateTurn is the event of a participant who has spoken, round 0 are the
+// opening answers and the judge speaks last with Final set
+type DebateTurn struct {
+	Round   int    `json:"round"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Final   bool   `json:"final,omitempty"`
+}
+
+func (DebateTurn) Kind() string { return "debate_turn" }
+
+// DebateTranscript is what gets written to log.json
+type DebateTranscript struct {
+	Prompt string       `json:"prompt"`
+	Turns  []DebateTurn `json:"turns"`
+	Final  string       `json:"final"`
+}
+
+var debaterPrompt = `You are %s, one of several experts debating a question.
+Give your best, self-contained answer. When shown the answers of the others, point out their mistakes,
+take over what they got right and give your improved answer. Be concise and concrete.`
+
+var critiquePrompt = `Round %d. The other participants answered:
+
+%s
+Critique their answers, then give your improved answer to the original question.`
+
+var judgePrompt = `You are the judge of a debate between %d experts.
+Read the final answers, weigh their arguments and write the single best answer to the question.
+Answer the question directly, do not describe the debate.`
+
+// Run holds the debate on p and returns the judge's answer. Debaters of one
+// round speak in parallel, a debater that fails is left out of later rounds
+func (d *Debate) Run(ctx context.Context, p string, onEvent func(Event)) (string, error) {
+	if len(d.Debaters) == 0 {
+		return "", errors.New("debate: no debaters")
+	}
+	var mu sync.Mutex
+	transcript := DebateTranscript{Prompt: p}
+	var total models.Usage
+	step := func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch v := ev.(type) {
+		case DebateTurn:
+			transcript.Turns = append(transcript.Turns, v)
+		case UsageUpdated:
+			total.Add(v.Usage)
+			v.Total = total
+			ev = v
+		}
+		onEvent(ev)
+	}
+	defer func() {
+		log.LogEvent("debate_transcript", transcript)
+	}()
+
+	for _, debater := range d.Debaters {
+		debater.Model.SetSystemPrompt(fmt.Sprintf(debaterPrompt, debater.Name))
+	}
+
+	// answers of the debaters still in the debate, by their index in d.Debaters
+	// as two debaters may share a name
+	everyone := make([]int, len(d.Debaters))
+	for i := range everyone {
+		everyone[i] = i
+	}
+	answers := d.round(ctx, 0, everyone, func(int) string { return p }, step)
+	for round := 1; round <= d.Rounds && len(answers) > 1; round++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		previous := answers
+		active := []int{}
+		for i := range d.Debaters {
+			if _, ok := previous[i]; ok {
+				active = append(active, i)
+			}
+		}
+		answers = d.round(ctx, round, active, func(i int) string {
+			var others strings.Builder
+			for _, other := range active {
+				if other != i {
+					others.WriteString("## " + d.Debaters[other].Name + "\n" + previous[other] + "\n\n")
+				}
+			}
+			return fmt.Sprintf(critiquePrompt, round, others.String())
+		}, step)
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if len(answers) == 0 {
+		return "", errors.New("debate: every debater failed")
+	}
+
+	var finals strings.Builder
+	finals.WriteString("Question:\n" + p + "\n\nFinal answers:\n\n")
+	for i, debater := range d.Debaters {
+		if answer, ok := answers[i]; ok {
+			finals.WriteString("## " + debater.Name + "\n" + answer + "\n\n")
+		}
+	}
+	d.Judge.Model.SetSystemPrompt(fmt.Sprintf(judgePrompt, len(answers)))
+	resp, err := d.Judge.Model.Completion(ctx, finals.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("judge: %w", err)
+	}
+	if resp.Usage != nil {
+		step(UsageUpdated{Usage: *resp.Usage})
+	}
+	transcript.Final = resp.Content
+	step(DebateTurn{Round: d.Rounds + 1, Name: d.Judge.Name, Content: resp.Content, Final: true})
+	return resp.Content, nil
+}
+
+// round asks the debaters at the indices active for their answer to prompt(i)
+// and returns the answers by index
+func (d *Debate) round(ctx context.Context, round int, active []int, prompt func(i int) string, step func(Event)) map[int]string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	answers := map[int]string{}
+	for _, i := range active {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			debater := d.Debaters[i]
+			resp, err := debater.Model.Completion(ctx, prompt(i), nil)
+			if err != nil {
+				if ctx.Err() == nil {
+					e := NewError("debate", err)
+					e.Message = debater.Name + ": " + e.Message
+					step(e)
+				}
+				return
+			}
+			if resp.Usage != nil {
+				step(UsageUpdated{Usage: *resp.Usage})
+			}
+			mu.Lock()
+			answers[i] = resp.Content
+			mu.Unlock()
+			step(DebateTurn{Round: round, Name: debater.Name, Content: resp.Content})
+		}(i)
+	}
+	wg.Wait()
+	return answers
+}
@@ -0,0 +1,83 @@
+package agent_test
+
+import (
+	"context"
+	"spysearch/agent"
+	"spysearch/models"
+	"strings"
+	"testing"
+)
+
+func TestDebate(t *testing.T) {
+	alice := models.NewScriptedClient(models.AssistantMessage("use a map"), models.AssistantMessage("use a map, sized up front"))
+	bob := models.NewScriptedClient(models.AssistantMessage("use a slice"), models.AssistantMessage("a map is better"))
+	judge := models.NewScriptedClient(models.AssistantMessage("use a map sized up front"))
+
+	d := &agent.Debate{
+		Debaters: []agent.Debater{{Name: "Alice", Model: alice}, {Name: "Bob", Model: bob}},
+		Judge:    agent.Debater{Name: "Judge", Model: judge},
+		Rounds:   1,
+	}
+	turns := []agent.DebateTurn{}
+	final, err := d.Run(context.Background(), "how to count words?", func(ev agent.Event) {
+		if turn, ok := ev.(agent.DebateTurn); ok {
+			turns = append(turns, turn)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != "use a map sized up front" || len(turns) != 5 || !turns[4].Final {
+		t.Fatalf("unexpected result %q after %d turns", final, len(turns))
+	}
+
+	// in the critique round every debater sees the other's opening answer
+	critique := alice.Requests[1][len(alice.Requests[1])-1].Content
+	if !strings.Contains(critique, "use a slice") || strings.Contains(critique, "use a map") {
+		t.Errorf("unexpected critique prompt %q", critique)
+	}
+	verdict := judge.Requests[0][len(judge.Requests[0])-1].Content
+	if !strings.Contains(verdict, "use a map, sized up front") || !strings.Contains(verdict, "a map is better") {
+		t.Errorf("the judge did not get the final answers: %q", verdict)
+	}
+}
+
+func TestDebateWithoutAnswers(t *testing.T) {
+	d := &agent.Debate{
+		Debaters: []agent.Debater{{Name: "Alice", Model: models.NewScriptedClient()}},
+		Judge:    agent.Debater{Name: "Judge", Model: models.NewScriptedClient()},
+	}
+	errs := []agent.Error{}
+	_, err := d.Run(context.Background(), "anything", func(ev agent.Event) {
+		if e, ok := ev.(agent.Error); ok {
+			errs = append(errs, e)
+		}
+	})
+	if err == nil || len(errs) != 1 || errs[0].Source != "debate" || !strings.HasPrefix(errs[0].Message, "Alice: ") {
+		t.Errorf("expected the failed debater to be reported, got %v, %q", err, errs)
+	}
+}
+
+func TestDebateSameNames(t *testing.T) {
+	first := models.NewScriptedClient(models.AssistantMessage("use a map"), models.AssistantMessage("still a map"))
+	second := models.NewScriptedClient(models.AssistantMessage("use a slice"), models.AssistantMessage("still a slice"))
+	judge := models.NewScriptedClient(models.AssistantMessage("a map"))
+
+	// two unnamed copies of one model end up with the same name
+	d := &agent.Debate{
+		Debaters: []agent.Debater{{Name: "qwen", Model: first}, {Name: "qwen", Model: second}},
+		Judge:    agent.Debater{Name: "Judge", Model: judge},
+		Rounds:   1,
+	}
+	if _, err := d.Run(context.Background(), "how to count words?", func(agent.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	critique := first.Requests[1][len(first.Requests[1])-1].Content
+	if !strings.Contains(critique, "use a slice") {
+		t.Errorf("the critique lost the other debater's answer: %q", critique)
+	}
+	verdict := judge.Requests[0][len(judge.Requests[0])-1].Content
+	if !strings.Contains(verdict, "still a map") || !strings.Contains(verdict, "still a slice") {
+		t.Errorf("the judge did not get both final answers: %q", verdict)
+	}
+}
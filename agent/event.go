@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"spysearch/log"
+	"spysearch/models"
+)
+
+// Event is a step of a run. Start delivers them in order on a channel, so the
+// TUI, the logs or a server consume the same stream. Kind names the event in logs
+type Event interface {
+	Kind() string
+}
+
+// RunStarted is the first event of a run
+type RunStarted struct {
+	Task   string `json:"task"`
+	Images int    `json:"images,omitempty"`
+	Steps  int    `json:"steps"`
+	Budget Budget `json:"budget"`
+}
+
+// ModelDelta is a piece of the reply of the model, the whole reply when it does not stream
+type ModelDelta struct {
+	Step    int    `json:"step"`
+	Content string `json:"content"`
+}
+
+// ReasoningDelta is a piece of what the model thought before its reply, when
+// the provider shows it, or of the plan of the run at step 0
+type ReasoningDelta struct {
+	Step    int    `json:"step"`
+	Content string `json:"content"`
+}
+
+// ModelReply is the complete reply of a step, after its deltas
+type ModelReply struct {
+	Step      int               `json:"step"`
+	Content   string            `json:"content"`
+	Reasoning string            `json:"reasoning,omitempty"`
+	ToolCalls []models.ToolCall `json:"tool_calls,omitempty"`
+}
+
+// UsageUpdated follows every reply that reported its usage
+type UsageUpdated struct {
+	Usage models.Usage `json:"usage"` // of the reply
+	Total models.Usage `json:"total"` // of the run so far
+}
+
+type ToolCallStarted struct {
+	Step      int            `json:"step"`
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+type ToolCallFinished struct {
+	Step      int            `json:"step"`
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+	Result    string         `json:"result"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// ApprovalRequested shows a change the user has to accept, edit or decline.
+// The run waits until the decision is sent on Reply, or ctx is done
+type ApprovalRequested struct {
+	ID     string `json:"id,omitempty"`
+	Tool   string `json:"tool"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+	Desc   string `json:"desc"`
+
+	Reply chan<- Approval `json:"-"` // buffered, sending never blocks
+}
+
+type Decision int
+
+const (
+	Accept Decision = iota
+	Edit            // the user changed the result, see Approval.Text
+	Decline
+)
+
+// Approval is the answer of the user to an ApprovalRequested
+type Approval struct {
+	Decision Decision
+	Text     string // the edited result when Decision is Edit
+}
+
+// FinishReason tells why a run ended
+type FinishReason string
+
+const (
+	FinishAnswer    FinishReason = "answer"     // the model answered without a tool
+	FinishDone      FinishReason = "done"       // the done tool was called
+	FinishStepLimit FinishReason = "step_limit" // Steps steps were used
+	FinishBudget    FinishReason = "budget"     // a limit of Budget was reached
+	FinishCancelled FinishReason = "cancelled"
+	FinishError     FinishReason = "error" // an Error event came first
+)
+
+// RunFinished is the last event of a run
+type RunFinished struct {
+	Reason FinishReason    `json:"reason"`
+	Result string          `json:"result,omitempty"` // the answer or the summary of done
+	Steps  int             `json:"steps"`
+	Usage  models.Usage    `json:"usage"`
+	Budget *BudgetExceeded `json:"budget,omitempty"` // the limit, when Reason is FinishBudget
+}
+
+// Error is a failure of the model or of a tool, Source says which
+type Error struct {
+	Source  string `json:"source"` // model, tool or debate
+	Message string `json:"message"`
+	ErrKind string `json:"error_kind,omitempty"` // see models.ErrorKind
+	Hint    string `json:"hint,omitempty"`       // see models.ErrorHint
+}
+
+// NewError describes err for an Error event
+func NewError(source string, err error) Error {
+	e := Error{Source: source, Message: err.Error(), Hint: models.ErrorHint(err)}
+	if kind := models.ErrorKindOf(err); kind != models.ErrUnknown {
+		e.ErrKind = kind.String()
+	}
+	return e
+}
+
+func (RunStarted) Kind() string        { return "run_started" }
+func (ModelDelta) Kind() string        { return "model_delta" }
+func (ReasoningDelta) Kind() string    { return "reasoning_delta" }
+func (ModelReply) Kind() string        { return "model_reply" }
+func (UsageUpdated) Kind() string      { return "usage_updated" }
+func (ToolCallStarted) Kind() string   { return "tool_call_started" }
+func (ToolCallFinished) Kind() string  { return "tool_call_finished" }
+func (ApprovalRequested) Kind() string { return "approval_requested" }
+func (RunFinished) Kind() string       { return "run_finished" }
+func (Error) Kind() string             { return "error" }
+
+// Tee hands every event of in to fn before passing it on
+func Tee(in <-chan Event, fn func(Event)) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		for ev := range in {
+			fn(ev)
+			out <- ev
+		}
+	}()
+	return out
+}
+
+// LogEvent writes ev to log.json under its kind, deltas are left out for the ModelReply
+func LogEvent(ev Event) {
+	switch ev.(type) {
+	case ModelDelta, ReasoningDelta:
+		return
+	}
+	log.LogEvent(ev.Kind(), ev)
+}
@@ -0,0 +1,20 @@
+package agent_test
+
+import (
+	"os"
+	"path/filepath"
+	"spysearch/log"
+	"testing"
+)
+
+// TestMain keeps the events logged by the tests out of the package directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "spysearch-log")
+	if err != nil {
+		panic(err)
+	}
+	log.SetFile(filepath.Join(dir, "log.json"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package agent
+
+import "os/exec"
+
+// killGroupOnCancel only kills cmd itself, WaitDelay stops waiting for its children
+func killGroupOnCancel(cmd *exec.Cmd) {}
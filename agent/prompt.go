@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"spysearch/models"
+	"spysearch/tools"
+	"strings"
+)
+
+// InstructionsFile holds project specific instructions, it is read from the
+// working directory and from ~/.spysearch for instructions of the user
+const InstructionsFile = "SPYSEARCH.md"
+
+// built in prompt describing how the agent works
+var agentPrompt = `You are Spy Agent, an autonomous coding agent running in the user's terminal.
+
+Working directory: %s
+Every command and file path is relative to this directory.
+
+You solve the task step by step with tools: %s.
+- Call a tool whenever you need to inspect or change something, never guess file contents.
+- Call one tool at a time and wait for its result before deciding the next step.
+- Tool results are sent back to you, the user does not see them.%s
+- When the task is finished call the "done" tool with a short summary for the user.
+- If no tool is needed, answer the user directly and concisely.`
+
+// the thinking tool is for the model's own reasoning, nothing calls it for it
+var thinkingToolPrompt = `
+- Before a task that takes several steps, call the "thinking" tool with your own plan. Call it again when a result changes the plan, the user sees what you wrote.`
+
+// models without native tool calling get the tool definitions in the prompt instead
+var fencedToolsPrompt = `
+- To call a tool, answer with a single block in this format and nothing else:
+` + "```json\n{\"name\": \"<tool name>\", \"arguments\": {...}}\n```" + `
+- The tools and their arguments are:
+%s`
+
+// SystemPrompt composes the built in agent prompt with the user and project
+// instructions, tools are described in it when caps has no native tool calling
+func SystemPrompt(workDir string, toolList []tools.Tool, caps models.Capabilities) string {
+	dir := workDir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	names := []string{}
+	extra := ""
+	for _, t := range toolList {
+		names = append(names, t.ToolFunction.Name)
+		if t.ToolFunction.Name == "thinking" {
+			extra += thinkingToolPrompt
+		}
+	}
+
+	if !caps.NativeTools {
+		defs, _ := json.MarshalIndent(toolList, "", "  ")
+		extra += fmt.Sprintf(fencedToolsPrompt, defs)
+	}
+	prompt := fmt.Sprintf(agentPrompt, dir, strings.Join(names, ", "), extra)
+	if instructions := LoadInstructions(workDir); instructions != "" {
+		prompt += "\n\n" + instructions
+	}
+	return prompt
+}
+
+// LoadInstructions reads the user-global and the project instructions file,
+// project instructions come last so they win when both disagree
+func LoadInstructions(workDir string) string {
+	paths := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".spysearch", InstructionsFile))
+	}
+	paths = append(paths, filepath.Join(workDir, InstructionsFile))
+
+	sections := []string{}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil || strings.TrimSpace(string(data)) == "" {
+			continue
+		}
+		sections = append(sections, "# Instructions from "+p+"\n\n"+strings.TrimSpace(string(data)))
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+var initPrompt = `Write a %s file for this repository. Coding agents read it before working on the project.
+Keep it short and factual, using markdown sections:
+- Overview: what the project is and its main packages or directories
+- Build & test: the exact commands
+- Conventions: code style, error handling, test layout you can infer
+- Notes: anything an agent must be careful about
+Only describe what the scan below shows. Reply with the file content only.
+
+%s`
+
+// InitInstructions drafts the project instructions file by scanning dir and
+// asking model to summarize it, an existing file is never overwritten
+func InitInstructions(ctx context.Context, model models.CompletionInterface, dir string) (string, error) {
+	path := filepath.Join(dir, InstructionsFile)
+	if _, err := os.Stat(path); err == nil {
+		return path, fmt.Errorf("%s already exists", path)
+	}
+
+	scan, err := ScanProject(dir)
+	if err != nil {
+		return path, err
+	}
+	resp, err := model.Completion(models.WithTask(ctx, models.TaskSummary), fmt.Sprintf(initPrompt, InstructionsFile, scan), nil)
+	if err != nil {
+		return path, err
+	}
+	content := strings.TrimSpace(resp.Content)
+	// models like to wrap the whole answer in a fence
+	if strings.HasPrefix(content, "```") {
+		content = strings.TrimPrefix(content, "```markdown")
+		content = strings.TrimPrefix(content, "```md")
+		content = strings.TrimPrefix(content, "```")
+		content = strings.TrimSuffix(strings.TrimSpace(content), "```")
+	}
+	if strings.TrimSpace(content) == "" {
+		return path, errors.New("the model returned an empty draft")
+	}
+	return path, os.WriteFile(path, []byte(strings.TrimSpace(content)+"\n"), 0644)
+}
+
+// files worth showing the model when drafting instructions
+var projectFiles = []string{"README.md", "go.mod", "package.json", "pyproject.toml", "Cargo.toml", "Makefile", "requirements.txt"}
+
+// ScanProject summarizes the layout of dir and its main manifest files
+func ScanProject(dir string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	var sb strings.Builder
+	sb.WriteString("## Files\n")
+
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if rel == "." {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() && (strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor") {
+			return filepath.SkipDir
+		}
+		if strings.Count(rel, string(filepath.Separator)) > 2 {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if count >= 200 {
+			return filepath.SkipAll
+		}
+		count++
+		if d.IsDir() {
+			rel += "/"
+		}
+		sb.WriteString(rel + "\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	names := append([]string{}, projectFiles...)
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		content := string(data)
+		if len(content) > 3000 {
+			content = content[:3000] + "\n..."
+		}
+		sb.WriteString("\n## " + name + "\n" + content + "\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,61 @@
+package agent_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"spysearch/agent"
+	"spysearch/models"
+	"spysearch/tools"
+	"strings"
+	"testing"
+)
+
+func TestSystemPromptLoadsInstructions(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	os.MkdirAll(filepath.Join(home, ".spysearch"), 0755)
+	os.WriteFile(filepath.Join(home, ".spysearch", agent.InstructionsFile), []byte("Answer in English."), 0644)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, agent.InstructionsFile), []byte("Run go test ./... before done."), 0644)
+
+	prompt := agent.SystemPrompt(dir, []tools.Tool{tools.NewBashTool().Tool, tools.NewDoneTool().Tool}, models.Capabilities{NativeTools: true})
+	for _, want := range []string{dir, "bash, done", "Answer in English.", "Run go test ./... before done."} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("system prompt is missing %q:\n%s", want, prompt)
+		}
+	}
+	// project instructions come after the user-global ones
+	if strings.Index(prompt, "Answer in English.") > strings.Index(prompt, "Run go test") {
+		t.Errorf("project instructions should follow the user-global ones")
+	}
+}
+
+func TestInitInstructionsKeepsExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, agent.InstructionsFile)
+	os.WriteFile(path, []byte("hand written"), 0644)
+
+	if _, err := agent.InitInstructions(context.Background(), nil, dir); err == nil {
+		t.Fatal("expected an error for an existing instructions file")
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "hand written" {
+		t.Errorf("instructions file was overwritten: %q", data)
+	}
+}
+
+func TestSystemPromptDescribesToolsWithoutNativeCalls(t *testing.T) {
+	toolList := []tools.Tool{tools.NewBashTool().Tool}
+	native := agent.SystemPrompt(t.TempDir(), toolList, models.Capabilities{NativeTools: true})
+	if strings.Contains(native, "```json") {
+		t.Errorf("native tool calling should not ask for fenced json:\n%s", native)
+	}
+	fenced := agent.SystemPrompt(t.TempDir(), toolList, models.Capabilities{})
+	for _, want := range []string{"```json", `"name": "bash"`, `"command"`} {
+		if !strings.Contains(fenced, want) {
+			t.Errorf("system prompt is missing %q:\n%s", want, fenced)
+		}
+	}
+}
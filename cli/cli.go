@@ -1,13 +1,18 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"spysearch/agent"
+	"spysearch/log"
 	"spysearch/models"
 	"spysearch/tools"
 
@@ -36,7 +41,184 @@ type settings struct {
 	Model    string `json:"model"`
 	ApiKey   string `json:"apiKey"`
 	Provider string `json:"provider"`
+	BaseURL  string `json:"baseURL"` // empty uses the provider default
 	WorkDir  string `json:"workDir"`
+
+	Prices models.PriceTable `json:"prices,omitempty"` // USD per million tokens
+
+	// context window, in estimated tokens
+	ContextBudget int                      `json:"contextBudget"`
+	MaxToolOutput int                      `json:"maxToolOutput"`
+	Models        map[string]modelSettings `json:"models,omitempty"` // per model overrides
+
+	// force well-formed tool calls with a json schema, for models without native tool calling
+	StructuredOutput bool `json:"structuredOutput"`
+
+	// sampling parameters, a model can override them under models
+	Options models.Options `json:"options"`
+
+	// provider "replay" answers from a cassette, record names the provider asked for missing requests
+	Cassette string `json:"cassette,omitempty"`
+	Record   string `json:"record,omitempty"`
+
+	Fallback []backendSettings          `json:"fallback,omitempty"` // tried in order when the provider fails
+	Routes   map[string]backendSettings `json:"routes,omitempty"`   // model per task, e.g. "thinking"
+
+	Cache cacheSettings `json:"cache"`
+
+	Debate debateSettings `json:"debate"`
+
+	Agent agentSettings `json:"agent"`
+}
+
+// agentSettings limit a \spyagent run, zero is unlimited and maxTime is a duration like "10m".
+// plan asks the model for a plan before the first step
+type agentSettings struct {
+	Steps        int     `json:"steps"`
+	Plan         bool    `json:"plan,omitempty"`
+	MaxTime      string  `json:"maxTime,omitempty"`
+	MaxTokens    int     `json:"maxTokens,omitempty"`
+	MaxBashCalls int     `json:"maxBashCalls,omitempty"`
+	MaxCost      float64 `json:"maxCost,omitempty"` // USD
+}
+
+func (a agentSettings) budget() agent.Budget {
+	b := agent.Budget{Tokens: a.MaxTokens, BashCalls: a.MaxBashCalls, Cost: a.MaxCost}
+	if d, err := time.ParseDuration(a.MaxTime); err == nil {
+		b.Time = d
+	}
+	return b
+}
+
+// debateSettings of \debate, without debaters two instances of the current model debate
+type debateSettings struct {
+	Rounds   int               `json:"rounds"`
+	Debaters []backendSettings `json:"debaters,omitempty"`
+	Judge    *backendSettings  `json:"judge,omitempty"` // nil uses the current model
+}
+
+// cacheSettings of the on-disk response cache, ttl is a duration like "24h"
+type cacheSettings struct {
+	Enabled   bool   `json:"enabled"`
+	Dir       string `json:"dir,omitempty"` // empty uses the user cache directory
+	TTL       string `json:"ttl,omitempty"`
+	MaxSizeMB int    `json:"maxSizeMB,omitempty"`
+}
+
+func (c cacheSettings) cacheConfig() models.CacheConfig {
+	cfg := models.CacheConfig{Dir: c.Dir, MaxBytes: int64(c.MaxSizeMB) << 20}
+	if cfg.Dir == "" {
+		cfg.Dir = models.DefaultCacheDir()
+	}
+	if ttl, err := time.ParseDuration(c.TTL); err == nil {
+		cfg.TTL = ttl
+	}
+	return cfg
+}
+
+// backendSettings is another provider and model used by fallback, routes and debates
+type backendSettings struct {
+	Name     string `json:"name,omitempty"` // debaters only
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	ApiKey   string `json:"apiKey,omitempty"`
+	BaseURL  string `json:"baseURL,omitempty"`
+}
+
+func (b backendSettings) llmConfig() models.Config {
+	return models.Config{Provider: b.Provider, Model: b.Model, APIKey: b.ApiKey, BaseURL: b.BaseURL}
+}
+
+// debate builds the debaters and the judge, every one with a client of its own
+func (s settings) debate() *agent.Debate {
+	newModel := func(b *backendSettings) models.CompletionInterface {
+		cfg := s.llmConfig()
+		if b != nil && b.Provider != "" {
+			cfg = b.llmConfig()
+			cfg.Prices, cfg.Context, cfg.Options = s.Prices, s.contextPolicy(), s.options(b.Model)
+		}
+		return models.NewLLMFromConfig(cfg)
+	}
+
+	d := &agent.Debate{
+		Rounds: s.Debate.Rounds,
+		Judge:  agent.Debater{Name: "Judge", Model: newModel(s.Debate.Judge)},
+	}
+	debaters := s.Debate.Debaters
+	if len(debaters) == 0 {
+		debaters = []backendSettings{{}, {}}
+	}
+	for i := range debaters {
+		name := debaters[i].Name
+		if name == "" {
+			name = fmt.Sprintf("Debater %d", i+1)
+			if debaters[i].Model != "" {
+				name += " (" + debaters[i].Model + ")"
+			}
+		}
+		d.Debaters = append(d.Debaters, agent.Debater{Name: name, Model: newModel(&debaters[i])})
+	}
+	return d
+}
+
+// modelSettings overrides the global settings for a single model
+type modelSettings struct {
+	ContextBudget    int            `json:"contextBudget,omitempty"`
+	StructuredOutput *bool          `json:"structuredOutput,omitempty"`
+	Options          models.Options `json:"options,omitempty"`
+}
+
+// options are the global sampling parameters with the overrides of model
+func (s settings) options(model string) models.Options {
+	return s.Options.Merge(s.Models[model].Options)
+}
+
+// contextPolicy is the global budget unless the model has its own
+func (s settings) contextPolicy() models.ContextPolicy {
+	p := models.ContextPolicy{Budget: s.ContextBudget, MaxToolOutput: s.MaxToolOutput}
+	if override, ok := s.Models[s.Model]; ok && override.ContextBudget > 0 {
+		p.Budget = override.ContextBudget
+	}
+	return p
+}
+
+func (s settings) llmConfig() models.Config {
+	cfg := models.Config{
+		Provider:   s.Provider,
+		Model:      s.Model,
+		APIKey:     s.ApiKey,
+		BaseURL:    s.BaseURL,
+		Prices:     s.Prices,
+		Context:    s.contextPolicy(),
+		Cassette:   s.Cassette,
+		Structured: s.StructuredOutput,
+		Options:    s.options(s.Model),
+		Record:     s.Record,
+	}
+	if override, ok := s.Models[s.Model]; ok && override.StructuredOutput != nil {
+		cfg.Structured = *override.StructuredOutput
+	}
+	if s.Cache.Enabled {
+		cfg.Cache = s.Cache.cacheConfig()
+	}
+	for _, b := range s.Fallback {
+		fallback := b.llmConfig()
+		fallback.Options = s.options(b.Model)
+		cfg.Fallback = append(cfg.Fallback, fallback)
+	}
+	if len(s.Routes) > 0 {
+		cfg.Routes = map[string]models.Config{}
+		for task, b := range s.Routes {
+			route := b.llmConfig()
+			route.Options = s.options(b.Model)
+			cfg.Routes[task] = route
+		}
+	}
+	return cfg
+}
+
+func formatUsage(label string, u models.Usage) string {
+	return fmt.Sprintf("%s: %d tok ($%.4f)", label, u.TotalTokens, u.Cost)
 }
 
 type Model struct {
@@ -50,16 +232,41 @@ type Model struct {
 	// Settings
 	settings     settings
 	waiting      bool
-	settingsMode int // 0: model, 1: provider, 2: apikey
+	streaming    bool               // the last message is still receiving tokens
+	thinking     bool               // the last message is a thought still receiving reasoning
+	thoughts     map[int]string     // reasoning of the model by index in messages, collapsed unless showThinking
+	showThinking bool               // toggled with ctrl+t
+	cancel       context.CancelFunc // stops the agent or chat request in flight
+	agentRunning bool
+
+	// token usage and cost
+	sessionUsage models.Usage
+	runUsage     models.Usage // last \spyagent run
+	settingsMode int          // row of settingFields
 
 	// Code review state
 	currentChange codeChange
+	approval      chan<- agent.Approval // set while the agent waits for the review of currentChange
 	showingSteps  bool
 	steps         []string
 	currentStep   int
 
 	editingSetting bool
 	editBuffer     string
+
+	// pick-list of the Model and Provider settings
+	picking     bool
+	pickLoading bool
+	pickFilter  string
+	pickIndex   int
+	pickOptions []models.ModelInfo
+	pickErr     string
+}
+
+// modelsLoadedMsg delivers the models of the configured provider to the pick-list
+type modelsLoadedMsg struct {
+	list []models.ModelInfo
+	err  error
 }
 
 // Clean color scheme
@@ -146,6 +353,13 @@ func loadConfig() settings {
 		ApiKey:   os.Getenv("OPENAI_API_KEY"),
 		Provider: "openai",
 		WorkDir:  "",
+
+		ContextBudget: 8000,
+		MaxToolOutput: 2000,
+
+		Cache:  cacheSettings{TTL: "24h", MaxSizeMB: 100},
+		Debate: debateSettings{Rounds: 1},
+		Agent:  agentSettings{Steps: agent.DefaultSteps},
 	}
 	data, err := ioutil.ReadFile("config.json")
 	if err == nil {
@@ -211,9 +425,32 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m.handleAgentResponse(msg)
 	case editorCompleteMsg:
 		return m.handleEditorComplete(msg)
+	case modelsLoadedMsg:
+		m.pickLoading = false
+		m.pickOptions, m.pickIndex = msg.list, 0
+		m.pickErr = ""
+		if msg.err != nil {
+			m.pickErr = msg.err.Error()
+		}
+		return m, nil
+	case streamMsg:
+		return m.handleStream(msg)
 	case runSpyAgentMsg:
 		m.waiting = false
-		m.messages = append(m.messages, agentStyle.Render(msg.result))
+		m.streaming = false
+		m.agentRunning = false
+		m.approval = nil
+		if m.cancel != nil {
+			m.cancel()
+			m.cancel = nil
+		}
+		// A chat that produced no tokens still shows its placeholder
+		if len(m.messages) > 0 && strings.Contains(m.messages[len(m.messages)-1], "Thinking...") {
+			m.messages = m.messages[:len(m.messages)-1]
+		}
+		if msg.result != "" {
+			m.messages = append(m.messages, agentStyle.Render(msg.result))
+		}
 		m.updateViewport()
 		return m, nil
 	}
@@ -241,8 +478,19 @@ func (m *Model) resizeComponents() {
 func (m Model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.String() {
 	case "ctrl+c":
+		// with a run in flight ctrl+c only stops the run
+		if m.cancel != nil {
+			return m.cancelRun()
+		}
 		return m, tea.Quit
 	case "esc":
+		if m.cancel != nil && m.view == VIEW_CHAT {
+			return m.cancelRun()
+		}
+		// the agent waits for the review, leaving it declines the change
+		if m.view == VIEW_CODE_REVIEW && m.approval != nil {
+			return m.approve(agent.Approval{Decision: agent.Decline}, "Changes declined")
+		}
 		if m.view == VIEW_CODE_REVIEW || m.view == VIEW_SETTINGS {
 			m.view = VIEW_CHAT
 			m.textarea.Focus()
@@ -268,6 +516,10 @@ func (m Model) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		if m.textarea.Value() != "" {
 			return m.processInput()
 		}
+	case "ctrl+t":
+		m.showThinking = !m.showThinking
+		m.updateViewport()
+		return m, nil
 	}
 
 	var cmd tea.Cmd
@@ -279,40 +531,51 @@ func (m Model) handleCodeReviewKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.String() {
 	case "a", "A":
 		// Accept changes
-		m.messages = append(m.messages, agentStyle.Render("AGENT")+": Changes accepted")
-		m.updateViewport()
-		m.view = VIEW_CHAT
-		m.textarea.Focus()
-		return m, nil
+		return m.approve(agent.Approval{Decision: agent.Accept}, "Changes accepted")
 	case "e", "E":
-		// Edit with vim
+		// Edit in $EDITOR, the edited text is sent once the editor exits
 		return m, m.openEditor()
 	case "d", "D":
 		// Decline changes
-		m.messages = append(m.messages, agentStyle.Render("AGENT")+": Changes declined")
-		m.updateViewport()
-		m.view = VIEW_CHAT
-		m.textarea.Focus()
-		return m, nil
+		return m.approve(agent.Approval{Decision: agent.Decline}, "Changes declined")
 	}
 	return m, nil
 }
 
+// approve answers the agent waiting on the review and goes back to the chat,
+// the agent carries on with the decision as the tool result
+func (m Model) approve(a agent.Approval, note string) (tea.Model, tea.Cmd) {
+	if m.approval != nil {
+		m.approval <- a
+		m.approval = nil
+	}
+	m.messages = append(m.messages, agentStyle.Render("AGENT")+": "+note)
+	m.updateViewport()
+	m.view = VIEW_CHAT
+	m.textarea.Focus()
+	return m, nil
+}
+
 func (m Model) handleSettingsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.picking {
+		return m.handlePickerKeys(msg)
+	}
 	switch msg.String() {
 	case "up", "k":
 		if !m.editingSetting && m.settingsMode > 0 {
 			m.settingsMode--
 		}
 	case "down", "j":
-		if !m.editingSetting && m.settingsMode < 3 {
+		if !m.editingSetting && m.settingsMode < len(settingFields)-1 {
 			m.settingsMode++
 		}
 	case "enter":
+		if !m.editingSetting && m.settingsMode <= 1 {
+			return m.startPicker(false)
+		}
 		if !m.editingSetting {
 			// Start editing
 			m.editingSetting = true
-			fields := []string{"Model", "Provider", "ApiKey", "WorkDir"}
 			var val string
 			switch m.settingsMode {
 			case 0:
@@ -322,10 +585,14 @@ func (m Model) handleSettingsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			case 2:
 				val = m.settings.ApiKey
 			case 3:
+				val = m.settings.BaseURL
+			case 4:
 				val = m.settings.WorkDir
+			default:
+				val = optionValue(m.settings.Options, m.settingsMode)
 			}
 			m.editBuffer = val
-			m.messages = append(m.messages, dimStyle.Render("Editing: "+fields[m.settingsMode]+" (type and Ctrl+S to save, Esc to cancel)"))
+			m.messages = append(m.messages, dimStyle.Render("Editing: "+settingFields[m.settingsMode]+" (type and Ctrl+S to save, Esc to cancel)"))
 			m.updateViewport()
 			return m, nil
 		}
@@ -340,7 +607,15 @@ func (m Model) handleSettingsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			case 2:
 				m.settings.ApiKey = m.editBuffer
 			case 3:
+				m.settings.BaseURL = m.editBuffer
+			case 4:
 				m.settings.WorkDir = m.editBuffer
+			default:
+				if err := setOption(&m.settings.Options, m.settingsMode, m.editBuffer); err != nil {
+					m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+settingFields[m.settingsMode]+": "+err.Error())
+					m.updateViewport()
+					return m, nil
+				}
 			}
 			m.editingSetting = false
 			m.editBuffer = ""
@@ -374,8 +649,237 @@ func (m Model) handleSettingsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// settingFields are the rows of the settings screen, from index 5 on the sampling options
+var settingFields = []string{"Model", "Provider", "ApiKey", "BaseURL", "WorkDir", "Temperature", "Top P", "Seed", "Max Tokens", "Stop", "Num Ctx"}
+
+// optionValue is the sampling option of settings row i as text, empty when unset
+func optionValue(o models.Options, i int) string {
+	switch i {
+	case 5:
+		if o.Temperature != nil {
+			return strconv.FormatFloat(*o.Temperature, 'g', -1, 64)
+		}
+	case 6:
+		if o.TopP != nil {
+			return strconv.FormatFloat(*o.TopP, 'g', -1, 64)
+		}
+	case 7:
+		if o.Seed != nil {
+			return strconv.Itoa(*o.Seed)
+		}
+	case 8:
+		if o.MaxTokens != 0 {
+			return strconv.Itoa(o.MaxTokens)
+		}
+	case 9:
+		return strings.Join(o.Stop, ", ")
+	case 10:
+		if o.NumCtx != 0 {
+			return strconv.Itoa(o.NumCtx)
+		}
+	}
+	return ""
+}
+
+// setOption parses v into the sampling option of settings row i, an empty v unsets it
+func setOption(o *models.Options, i int, v string) error {
+	v = strings.TrimSpace(v)
+	var f float64
+	var n int
+	var err error
+	switch i {
+	case 5, 6:
+		if v != "" {
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return errors.New("expected a number")
+			}
+		}
+	case 7, 8, 10:
+		if v != "" {
+			if n, err = strconv.Atoi(v); err != nil {
+				return errors.New("expected a whole number")
+			}
+		}
+	}
+
+	switch i {
+	case 5:
+		o.Temperature = nil
+		if v != "" {
+			o.Temperature = &f
+		}
+	case 6:
+		o.TopP = nil
+		if v != "" {
+			o.TopP = &f
+		}
+	case 7:
+		o.Seed = nil
+		if v != "" {
+			o.Seed = &n
+		}
+	case 8:
+		o.MaxTokens = n
+	case 9:
+		o.Stop = nil
+		for _, stop := range strings.Split(v, ",") {
+			if stop = strings.TrimSpace(stop); stop != "" {
+				o.Stop = append(o.Stop, stop)
+			}
+		}
+	case 10:
+		o.NumCtx = n
+	}
+	return nil
+}
+
+// formatCapabilities is the detail of a provider in the pick-list
+func formatCapabilities(c models.Capabilities) string {
+	caps := []string{}
+	for _, f := range []struct {
+		name string
+		ok   bool
+	}{{"tools", c.NativeTools}, {"streaming", c.Streaming}, {"vision", c.Vision}, {"json", c.JSONMode}} {
+		if f.ok {
+			caps = append(caps, f.name)
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+// startPicker opens the pick-list of the Model or Provider setting
+func (m Model) startPicker(refresh bool) (tea.Model, tea.Cmd) {
+	m.picking = true
+	m.pickFilter, m.pickIndex, m.pickErr = "", 0, ""
+	if m.settingsMode == 1 {
+		m.pickOptions = []models.ModelInfo{}
+		for _, name := range models.Providers() {
+			p, _ := models.LookupProvider(name)
+			m.pickOptions = append(m.pickOptions, models.ModelInfo{ID: name, Details: formatCapabilities(p.Capabilities)})
+		}
+		return m, nil
+	}
+	m.pickOptions = nil
+	m.pickLoading = true
+	cfg := m.settings.llmConfig()
+	return m, func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		list, err := models.DefaultModelCache().ListModels(ctx, cfg, refresh)
+		return modelsLoadedMsg{list: list, err: err}
+	}
+}
+
+// handlePickerKeys filters the pick-list as the user types, Enter takes the
+// selected entry or, when nothing matches, the typed name
+func (m Model) handlePickerKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	filtered := models.FilterModels(m.pickOptions, m.pickFilter)
+	switch msg.Type {
+	case tea.KeyUp:
+		if m.pickIndex > 0 {
+			m.pickIndex--
+		}
+	case tea.KeyDown:
+		if m.pickIndex < len(filtered)-1 {
+			m.pickIndex++
+		}
+	case tea.KeyEsc:
+		m.picking, m.pickLoading = false, false
+	case tea.KeyCtrlR:
+		if m.settingsMode == 0 {
+			return m.startPicker(true)
+		}
+	case tea.KeyBackspace:
+		if len(m.pickFilter) > 0 {
+			m.pickFilter = m.pickFilter[:len(m.pickFilter)-1]
+			m.pickIndex = 0
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.pickFilter += msg.String()
+		m.pickIndex = 0
+	case tea.KeyEnter:
+		value := strings.TrimSpace(m.pickFilter)
+		if len(filtered) > 0 {
+			value = filtered[m.pickIndex].ID
+		}
+		if value == "" {
+			return m, nil
+		}
+		if m.settingsMode == 0 {
+			m.settings.Model = value
+		} else {
+			m.settings.Provider = value
+		}
+		m.picking = false
+		saveConfig(m.settings)
+		m.messages = append(m.messages, agentStyle.Render("SETTINGS updated and saved."))
+		if p, ok := models.LookupProvider(m.settings.Provider); ok && m.settingsMode == 1 {
+			if missing := p.Missing(m.settings.llmConfig()); len(missing) > 0 {
+				m.messages = append(m.messages, agentStyle.Render("SETTINGS")+": "+value+" also needs "+strings.Join(missing, ", "))
+			}
+		}
+		m.updateViewport()
+	}
+	return m, nil
+}
+
+// pickerView renders the filter and the entries around the selection
+func (m Model) pickerView() string {
+	lines := []string{"Filter: " + m.pickFilter + "_"}
+	if m.pickLoading {
+		return strings.Join(append(lines, dimStyle.Render("Loading models...")), "\n")
+	}
+	if m.pickErr != "" {
+		lines = append(lines, errorStyle.Render("Could not list models: "+m.pickErr), dimStyle.Render("Type the name and press Enter"))
+	}
+	filtered := models.FilterModels(m.pickOptions, m.pickFilter)
+	if len(filtered) == 0 && m.pickErr == "" {
+		lines = append(lines, dimStyle.Render("No match, Enter uses the typed name"))
+	}
+
+	const shown = 10
+	start := 0
+	if m.pickIndex >= shown {
+		start = m.pickIndex - shown + 1
+	}
+	for i := start; i < len(filtered) && i < start+shown; i++ {
+		line := formatModelInfo(filtered[i])
+		if i == m.pickIndex {
+			line = selectedStyle.Render("> " + line)
+		} else {
+			line = "  " + line
+		}
+		lines = append(lines, line)
+	}
+	if len(filtered) > shown {
+		lines = append(lines, dimStyle.Render(fmt.Sprintf("%d of %d models", len(filtered), len(m.pickOptions))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatModelInfo shows the metadata the provider reported next to the id
+func formatModelInfo(info models.ModelInfo) string {
+	parts := []string{info.ID}
+	if info.ContextLength > 0 {
+		parts = append(parts, fmt.Sprintf("%dk ctx", info.ContextLength/1000))
+	}
+	if info.Price != nil {
+		parts = append(parts, fmt.Sprintf("$%.2f/$%.2f per 1M", info.Price.Input, info.Price.Output))
+	}
+	if info.Details != "" {
+		parts = append(parts, info.Details)
+	}
+	return strings.Join(parts, "  ")
+}
+
 func (m Model) processInput() (tea.Model, tea.Cmd) {
 	input := strings.TrimSpace(m.textarea.Value())
+	// one run at a time, it owns m.cancel until its stream is closed
+	if m.waiting && startsRun(input) {
+		m.messages = append(m.messages, errorStyle.Render("ERROR")+": Still running, wait for it or press Esc to cancel it")
+		m.updateViewport()
+		return m, nil
+	}
 	m.messages = append(m.messages, promptStyle.Render("YOU")+": "+input)
 	m.updateViewport()
 	m.textarea.Reset()
@@ -386,10 +890,81 @@ func (m Model) processInput() (tea.Model, tea.Cmd) {
 	}
 
 	// Normal chat - send to agent
+	msg, err := attachImages(input, m.settings.WorkDir)
+	if err != nil {
+		m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+err.Error())
+		m.updateViewport()
+		return m, nil
+	}
 	m.waiting = true
 	m.messages = append(m.messages, agentStyle.Render("AGENT")+": Thinking...")
 	m.updateViewport()
-	return m, m.callAgentChat(input)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	return m, m.callAgentChat(ctx, msg)
+}
+
+// startsRun tells if input is a chat message or a command that calls the model
+func startsRun(input string) bool {
+	switch strings.SplitN(input, " ", 2)[0] {
+	case "\\spyagent", "\\debate", "\\init":
+		return true
+	}
+	return !strings.HasPrefix(input, "\\")
+}
+
+// attachImages turns `@image path` in input into images of the user message,
+// paths are relative to workDir and may be quoted when they contain spaces
+func attachImages(input, workDir string) (models.LLMMessage, error) {
+	msg := models.LLMMessage{Role: "user"}
+	text := []string{}
+	rest := input
+	for {
+		i := strings.Index(rest, "@image ")
+		if i < 0 {
+			text = append(text, rest)
+			break
+		}
+		text = append(text, rest[:i])
+		rest = strings.TrimLeft(rest[i+len("@image "):], " ")
+		var path string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return msg, errors.New("unterminated quote after @image")
+			}
+			path, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			path, rest = rest[:end], rest[end:]
+		}
+		if path == "" {
+			return msg, errors.New("usage: @image path")
+		}
+		if !filepath.IsAbs(path) && workDir != "" {
+			path = filepath.Join(workDir, path)
+		}
+		img, err := models.LoadImage(path)
+		if err != nil {
+			return msg, err
+		}
+		msg.Images = append(msg.Images, img)
+	}
+	msg.Content = strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+	return msg, nil
+}
+
+// cancelRun stops the agent or chat request that is in flight without quitting
+func (m Model) cancelRun() (tea.Model, tea.Cmd) {
+	m.cancel()
+	m.cancel = nil
+	m.streaming = false
+	m.messages = append(m.messages, dimStyle.Render("Cancelling..."))
+	m.updateViewport()
+	return m, nil
 }
 
 func (m Model) handleCommand(input string) (tea.Model, tea.Cmd) {
@@ -399,8 +974,13 @@ func (m Model) handleCommand(input string) (tea.Model, tea.Cmd) {
 	switch command {
 	case "\\spyagent":
 		if len(parts) > 1 {
-			prompt := strings.TrimSpace(parts[1])
-			if prompt != "" {
+			task, err := attachImages(parts[1], m.settings.WorkDir)
+			if err != nil {
+				m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+err.Error())
+				m.updateViewport()
+				return m, nil
+			}
+			if task.Content != "" {
 				ag := &agent.SpyAgent{
 					Tools: []tools.Tool{
 						tools.NewDoneTool().Tool,
@@ -408,57 +988,113 @@ func (m Model) handleCommand(input string) (tea.Model, tea.Cmd) {
 						tools.NewBashTool().Tool,
 						tools.NewThinkingTool().Tool,
 					},
-					Steps: 5,
-					Mmeory: []string{},
-					Model:  models.NewLLMFromConfig(m.settings.Model, m.settings.ApiKey, m.settings.Provider),
+					Steps:   m.settings.Agent.Steps,
+					Plan:    m.settings.Agent.Plan,
+					Budget:  m.settings.Agent.budget(),
+					Mmeory:  []string{},
+					Model:   models.NewLLMFromConfig(m.settings.llmConfig()),
 					WorkDir: m.settings.WorkDir,
 				}
 				m.waiting = true
 				m.messages = append(m.messages, agentStyle.Render("SPY AGENT")+": Starting autonomous reasoning...")
 				m.updateViewport()
-				return m, func() tea.Msg {
-					return runSpyAgentMsg{result: runSpyAgentWithCallback(ag, prompt, func(msg string, review *agent.CodeReviewMsg) {
-						if review != nil {
-							// Show code diff and prompt user
-							m.currentChange = codeChange{
-								filename: "(modifier)",
-								before:   review.Before,
-								after:    review.After,
-							}
-							m.messages = append(m.messages, agentStyle.Render("AGENT")+": Modifier tool result. Accept (A), Edit (E), or Decline (D)?")
-							m.view = VIEW_CODE_REVIEW
-							m.updateViewport()
-							return
-						}
-						if msg != "" {
-							m.messages = append(m.messages, msg)
-							m.updateViewport()
-						}
-					})}
-				}
+				ctx, cancel := context.WithCancel(context.Background())
+				m.cancel = cancel
+				m.agentRunning = true
+				m.runUsage = models.Usage{}
+				return m, runSpyAgent(ctx, ag, task)
 			}
 		}
 		m.messages = append(m.messages, errorStyle.Render("ERROR")+": Usage: \\spyagent {prompt}")
 		m.updateViewport()
 		return m, nil
+	case "\\init":
+		m.waiting = true
+		m.messages = append(m.messages, agentStyle.Render("SPY AGENT")+": Scanning the project to draft "+agent.InstructionsFile+"...")
+		m.updateViewport()
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancel = cancel
+		return m, initInstructions(ctx, models.NewLLMFromConfig(m.settings.llmConfig()), m.settings.WorkDir)
+	case "\\debate":
+		if len(parts) > 1 {
+			prompt := strings.TrimSpace(parts[1])
+			if prompt != "" {
+				d := m.settings.debate()
+				m.waiting = true
+				m.messages = append(m.messages, agentStyle.Render("DEBATE")+fmt.Sprintf(": %d debaters, %d critique rounds...", len(d.Debaters), d.Rounds))
+				m.updateViewport()
+				ctx, cancel := context.WithCancel(context.Background())
+				m.cancel = cancel
+				return m, runDebate(ctx, d, prompt)
+			}
+		}
+		m.messages = append(m.messages, errorStyle.Render("ERROR")+": Usage: \\debate {prompt}")
+		m.updateViewport()
+		return m, nil
+	case "\\cache":
+		cache := models.NewResponseCache(m.settings.Cache.cacheConfig())
+		arg := ""
+		if len(parts) > 1 {
+			arg = strings.TrimSpace(parts[1])
+		}
+		switch arg {
+		case "clear":
+			n, err := cache.Clear()
+			if err != nil {
+				m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+err.Error())
+			} else {
+				m.messages = append(m.messages, agentStyle.Render("CACHE")+fmt.Sprintf(": removed %d entries from %s", n, cache.Dir))
+			}
+		case "stats":
+			st, err := cache.Stats()
+			if err != nil {
+				m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+err.Error())
+				break
+			}
+			state := "disabled"
+			if m.settings.Cache.Enabled {
+				state = "enabled"
+			}
+			m.messages = append(m.messages, agentStyle.Render("CACHE")+fmt.Sprintf(": %s, %d entries, %.1f MB in %s, %d hits / %d misses this session",
+				state, st.Entries, float64(st.Bytes)/(1<<20), cache.Dir, st.Hits, st.Misses))
+		default:
+			m.messages = append(m.messages, errorStyle.Render("ERROR")+": Usage: \\cache clear|stats")
+		}
+		m.updateViewport()
+		return m, nil
 	case "\\settings":
 		m.view = VIEW_SETTINGS
 		m.textarea.Blur()
 		return m, nil
 	case "\\clear":
 		m.messages = []string{}
+		m.thoughts = nil
 		m.updateViewport()
 	case "\\help":
 		help := `Commands:
   \\spyagent {prompt}   - Run the autonomous agent on your prompt
+  \\debate {prompt}     - Let several models debate the prompt, a judge gives the final answer
+  \\init               - Draft a ` + agent.InstructionsFile + ` with project instructions for the agent
+  \\cache clear|stats  - Empty the response cache or show its size and hit rate
   \\settings           - Configure model, API, provider, and working directory
   \\clear              - Clear screen
   \\help               - Show this help
 
 Settings:
   Up/Down - Navigate options
-  Enter   - Save current value
-  ESC     - Back to chat`
+  Enter   - Edit, Model and Provider open a list to filter by typing (Ctrl+R reloads the models)
+  ESC     - Back to chat
+
+Attach images to a chat message or \\spyagent prompt with @image path (png, jpeg, gif, webp), e.g.
+  why does this page look broken? @image screenshots/home.png
+
+What the model thinks before it answers, when the provider shows it, or the plan of \\spyagent
+with "plan": true under "agent" in the config, is one line in the chat, Ctrl+T expands or collapses it
+
+Instructions from ` + agent.InstructionsFile + ` in the working directory and ~/.spysearch/ are added to every request
+
+Providers: ` + strings.Join(models.Providers(), " | ") + `
+  Base URL points ollama or openai-compatible servers (vLLM, llama.cpp, LM Studio) at another host`
 		m.messages = append(m.messages, agentStyle.Render("HELP")+": "+help)
 		m.updateViewport()
 	default:
@@ -469,11 +1105,36 @@ Settings:
 }
 
 func (m *Model) updateViewport() {
-	content := strings.Join(m.messages, "\n")
-	m.viewport.SetContent(content)
+	m.viewport.SetContent(m.transcript())
 	m.viewport.GotoBottom()
 }
 
+// addThought adds a collapsed section with the reasoning of the model
+func (m *Model) addThought(text string) {
+	if m.thoughts == nil {
+		m.thoughts = map[int]string{}
+	}
+	m.messages = append(m.messages, "")
+	m.thoughts[len(m.messages)-1] = text
+}
+
+// transcript joins the messages, the reasoning of the model is one line unless showThinking
+func (m Model) transcript() string {
+	lines := make([]string, len(m.messages))
+	for i, msg := range m.messages {
+		thought, ok := m.thoughts[i]
+		switch {
+		case !ok:
+			lines[i] = msg
+		case m.showThinking:
+			lines[i] = dimStyle.Render("▾ Thinking (Ctrl+T to collapse)\n" + strings.TrimSpace(thought))
+		default:
+			lines[i] = dimStyle.Render(fmt.Sprintf("▸ Thinking · %d words (Ctrl+T to expand)", len(strings.Fields(thought))))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // Agent message types
 type agentStepMsg struct {
 	step string
@@ -492,22 +1153,60 @@ type agentResponseMsg struct {
 type editorCompleteMsg struct {
 	success bool
 	message string
+	text    string // the edited content
 }
 
-func (m Model) callAgentChat(message string) tea.Cmd {
-	return func() tea.Msg {
-		llm := models.NewLLMFromConfig(m.settings.Model, m.settings.ApiKey, m.settings.Provider)
-		resp, err := llm.Completion(message, []tools.Tool{})
-		if err != nil {
-			return agentResponseMsg{response: "[Error] " + err.Error()}
+func (m Model) callAgentChat(ctx context.Context, message models.LLMMessage) tea.Cmd {
+	llm := models.NewLLMFromConfig(m.settings.llmConfig())
+	llm.SetSystemPrompt(agent.LoadInstructions(m.settings.WorkDir))
+	ch := make(chan agent.Event)
+	go func() {
+		defer close(ch)
+		stream, ok := llm.(models.StreamingCompletion)
+		if !ok || !llm.Capabilities().Streaming {
+			resp, err := llm.Chat(ctx, []models.LLMMessage{message}, []tools.Tool{})
+			if err != nil {
+				ch <- chatError(err)
+				return
+			}
+			if resp.Thinking != "" {
+				ch <- agent.ReasoningDelta{Content: resp.Thinking}
+			}
+			ch <- agent.ModelDelta{Content: resp.Content}
+			sendChatUsage(ch, resp)
+			return
 		}
-		// Simulate streaming by word
-		for _, word := range strings.Split(resp.Content, " ") {
-			m.messages = append(m.messages, "[LLM] "+word)
-			m.updateViewport()
+		resp, err := stream.ChatStream(ctx, []models.LLMMessage{message}, []tools.Tool{}, func(chunk models.StreamChunk) {
+			if chunk.Thinking != "" {
+				ch <- agent.ReasoningDelta{Content: chunk.Thinking}
+			}
+			if chunk.Content != "" {
+				ch <- agent.ModelDelta{Content: chunk.Content}
+			}
+		})
+		if err != nil {
+			ch <- chatError(err)
+			return
 		}
-		return agentResponseMsg{response: resp.Content}
+		sendChatUsage(ch, resp)
+	}()
+	return waitForStream(ch, "")
+}
+
+func sendChatUsage(ch chan<- agent.Event, resp models.LLMMessage) {
+	if resp.Usage == nil {
+		return
 	}
+	log.LogEvent("chat_usage", resp.Usage)
+	ch <- agent.UsageUpdated{Usage: *resp.Usage}
+}
+
+// chatError explains a failed provider call, e.g. a 401 asks to check the api key
+func chatError(err error) agent.Event {
+	if errors.Is(err, context.Canceled) {
+		return agent.RunFinished{Reason: agent.FinishCancelled}
+	}
+	return agent.NewError("model", err)
 }
 
 func (m Model) callAgent(prompt string) tea.Cmd {
@@ -603,6 +1302,10 @@ func (m Model) handleAgentCode(msg agentCodeMsg) (tea.Model, tea.Cmd) {
 func (m Model) openEditor() tea.Cmd {
 	// Create temporary file with the "after" code
 	tmpFile := "/tmp/agent_edit_" + fmt.Sprintf("%d", time.Now().Unix()) + ".go"
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vim"
+	}
 
 	return tea.Sequence(
 		tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
@@ -612,13 +1315,13 @@ func (m Model) openEditor() tea.Cmd {
 			}
 			return nil
 		}),
-		tea.ExecProcess(exec.Command("vim", tmpFile), func(err error) tea.Msg {
+		tea.ExecProcess(exec.Command(editor, tmpFile), func(err error) tea.Msg {
 			if err != nil {
 				return editorCompleteMsg{success: false, message: "Editor failed: " + err.Error()}
 			}
 
 			// Read the modified content
-			_, readErr := os.ReadFile(tmpFile)
+			edited, readErr := os.ReadFile(tmpFile)
 			if readErr != nil {
 				return editorCompleteMsg{success: false, message: "Failed to read edited file"}
 			}
@@ -626,18 +1329,21 @@ func (m Model) openEditor() tea.Cmd {
 			// Clean up temp file
 			os.Remove(tmpFile)
 
-			return editorCompleteMsg{success: true, message: "File edited successfully"}
+			return editorCompleteMsg{success: true, message: "File edited successfully", text: string(edited)}
 		}),
 	)
 }
 
 func (m Model) handleEditorComplete(msg editorCompleteMsg) (tea.Model, tea.Cmd) {
 	if msg.success {
-		m.messages = append(m.messages, agentStyle.Render("AGENT")+": "+msg.message)
-	} else {
-		m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+msg.message)
+		return m.approve(agent.Approval{Decision: agent.Edit, Text: msg.text}, msg.message)
 	}
+	m.messages = append(m.messages, errorStyle.Render("ERROR")+": "+msg.message)
 	m.updateViewport()
+	// the agent still waits, the change can be reviewed again
+	if m.approval != nil {
+		return m, nil
+	}
 
 	m.view = VIEW_CHAT
 	m.textarea.Focus()
@@ -664,6 +1370,11 @@ func (m Model) chatView() string {
 		status += " | API: Not configured"
 	}
 
+	status += " | " + formatUsage("Session", m.sessionUsage)
+	if m.runUsage.TotalTokens > 0 {
+		status += " | " + formatUsage("Last run", m.runUsage)
+	}
+
 	if m.waiting {
 		status += " | Processing..."
 	}
@@ -678,7 +1389,7 @@ func (m Model) chatView() string {
 	}
 	m.viewport.Width = w
 	m.viewport.Height = h
-	m.viewport.SetContent(strings.Join(m.messages, "\n"))
+	m.viewport.SetContent(m.transcript())
 	m.viewport.YOffset = 0
 	m.viewport.GotoBottom()
 	// Wrapping is handled by lipgloss, no SetWrap method
@@ -691,7 +1402,7 @@ func (m Model) chatView() string {
 		"",
 		m.textarea.View(),
 		"",
-		dimStyle.Render("Chat normally or use: \\spyagent {prompt} | \\settings | \\help | Ctrl+C: quit"))
+		dimStyle.Render("Chat normally or use: \\spyagent {prompt} | \\settings | \\help | Ctrl+T: thinking | Ctrl+C: quit"))
 }
 
 func (m Model) codeReviewView() string {
@@ -722,12 +1433,16 @@ func (m Model) codeReviewView() string {
 	m.viewport.GotoBottom()
 	// Wrapping is handled by lipgloss, no SetWrap method
 
+	keys := "A: Accept | E: Edit | D: Decline | ESC: Back"
+	if m.approval != nil {
+		keys = "A: Accept | E: Edit | D/ESC: Decline"
+	}
 	return lipgloss.JoinVertical(lipgloss.Left,
 		headerStyle.Width(m.width).Render("CODE REVIEW: "+m.currentChange.filename),
 		"",
 		diff,
 		"",
-		dimStyle.Render("A: Accept | E: Edit | D: Decline | ESC: Back"))
+		dimStyle.Render(keys))
 }
 
 func (m Model) settingsView() string {
@@ -738,10 +1453,31 @@ func (m Model) settingsView() string {
 			if m.settings.ApiKey == "" {
 				return "Not set"
 			}
+			// local openai compatible servers often take a dummy key
+			if len(m.settings.ApiKey) <= 4 {
+				return "***"
+			}
 			return "***" + m.settings.ApiKey[len(m.settings.ApiKey)-4:]
 		}()),
+		fmt.Sprintf("Base URL: %s", func() string {
+			if m.settings.BaseURL == "" {
+				return "Provider default"
+			}
+			return m.settings.BaseURL
+		}()),
 		fmt.Sprintf("WorkDir: %s", m.settings.WorkDir),
 	}
+	effective := m.settings.options(m.settings.Model)
+	for i := 5; i < len(settingFields); i++ {
+		value := optionValue(m.settings.Options, i)
+		if value == "" {
+			value = "default"
+		}
+		if override := optionValue(effective, i); override != optionValue(m.settings.Options, i) {
+			value += " (" + m.settings.Model + ": " + override + ")"
+		}
+		options = append(options, settingFields[i]+": "+value)
+	}
 
 	var renderedOptions []string
 	for i, option := range options {
@@ -757,13 +1493,18 @@ func (m Model) settingsView() string {
 	}
 
 	settingsContent := strings.Join(renderedOptions, "\n")
+	help := "Up/Down: Navigate | Enter: Edit | Ctrl+S: Save | ESC: Cancel/Back"
+	if m.picking {
+		settingsContent += "\n\n" + m.pickerView()
+		help = "Type to filter | Up/Down: Select | Enter: Pick | Ctrl+R: Refresh models | ESC: Cancel"
+	}
 
 	return lipgloss.JoinVertical(lipgloss.Left,
 		headerStyle.Width(m.width).Render("SETTINGS"),
 		"",
 		settingsStyle.Width(m.width-4).Render(settingsContent),
 		"",
-		dimStyle.Render("Up/Down: Navigate | Enter: Edit | Ctrl+S: Save | ESC: Cancel/Back"))
+		dimStyle.Render(help))
 }
 
 func Run() error {
@@ -778,24 +1519,152 @@ type runSpyAgentMsg struct {
 	result string
 }
 
-// Helper to run the agent and call a callback for each step
-func runSpyAgentWithCallback(ag *agent.SpyAgent, prompt string, onStep func(string, *agent.CodeReviewMsg)) string {
-	done := make(chan struct{})
+// streamMsg carries one event of a running agent or chat from its goroutine to Update
+type streamMsg struct {
+	step  agent.Event
+	ch    <-chan agent.Event
+	final string
+}
+
+// waitForStream delivers the next event of ch, final is shown once ch is closed
+func waitForStream(ch <-chan agent.Event, final string) tea.Cmd {
+	return func() tea.Msg {
+		step, ok := <-ch
+		if !ok {
+			return runSpyAgentMsg{result: final}
+		}
+		return streamMsg{step: step, ch: ch, final: final}
+	}
+}
+
+// runSpyAgent starts the agent in the background and streams its steps into the TUI
+func runSpyAgent(ctx context.Context, ag *agent.SpyAgent, task models.LLMMessage) tea.Cmd {
+	return waitForStream(ag.Start(ctx, task), "[SPY AGENT] Finished.")
+}
+
+// runDebate holds the debate in the background and streams every turn into the TUI
+func runDebate(ctx context.Context, d *agent.Debate, prompt string) tea.Cmd {
+	ch := make(chan agent.Event)
 	go func() {
-		ag.RunWithCallback(prompt, func(msg interface{}) {
-			switch v := msg.(type) {
-			case string:
-				if strings.HasPrefix(v, "[USING TOOL]") {
-					onStep(v, nil)
-					return
-				}
-				onStep(v, nil)
-			case agent.CodeReviewMsg:
-				onStep("", &v)
-			}
-		})
-		done <- struct{}{}
+		defer close(ch)
+		if _, err := d.Run(ctx, prompt, func(ev agent.Event) {
+			ch <- ev
+		}); err != nil {
+			ch <- chatError(err)
+		}
+	}()
+	return waitForStream(ch, "")
+}
+
+// initInstructions drafts the project instructions file in the background
+func initInstructions(ctx context.Context, llm models.CompletionInterface, dir string) tea.Cmd {
+	if dir == "" {
+		dir = "."
+	}
+	ch := make(chan agent.Event)
+	go func() {
+		defer close(ch)
+		path, err := agent.InitInstructions(ctx, llm, dir)
+		if err != nil {
+			ch <- chatError(err)
+			return
+		}
+		ch <- agent.RunFinished{Reason: agent.FinishDone, Result: "wrote " + path + ", review it and edit as you like."}
 	}()
-	<-done
-	return "[SPY AGENT] Finished."
+	return waitForStream(ch, "")
+}
+
+func (m Model) handleStream(msg streamMsg) (tea.Model, tea.Cmd) {
+	// Replace the "Thinking..." placeholder of a chat with whatever arrives first
+	if !m.streaming && len(m.messages) > 0 && strings.Contains(m.messages[len(m.messages)-1], "Thinking...") {
+		m.messages = m.messages[:len(m.messages)-1]
+	}
+
+	if _, ok := msg.step.(agent.ModelDelta); !ok {
+		m.streaming = false
+	}
+	if _, ok := msg.step.(agent.ReasoningDelta); !ok {
+		m.thinking = false
+	}
+	switch v := msg.step.(type) {
+	case agent.ReasoningDelta:
+		// the deltas of a reply go to the same thought
+		if !m.thinking {
+			m.addThought("")
+			m.thinking = true
+		}
+		m.thoughts[len(m.messages)-1] += v.Content
+	case agent.ModelDelta:
+		if m.streaming && len(m.messages) > 0 {
+			m.messages[len(m.messages)-1] += v.Content
+		} else {
+			m.messages = append(m.messages, agentStyle.Render("AGENT")+": "+v.Content)
+			m.streaming = true
+		}
+	case agent.UsageUpdated:
+		m.sessionUsage.Add(v.Usage)
+		if m.agentRunning {
+			m.runUsage.Add(v.Usage)
+		}
+	case agent.ToolCallStarted:
+		// thinking is shown once it has a result
+		if v.Name != "thinking" {
+			m.messages = append(m.messages, "[USING TOOL] "+v.Name)
+		}
+	case agent.ToolCallFinished:
+		switch v.Name {
+		case "thinking":
+			m.addThought(v.Result)
+		case "bash":
+			m.messages = append(m.messages, "[BASH OUTPUT] "+v.Result)
+		case "modifier":
+			// the change is shown by the approval that follows
+		default:
+			m.messages = append(m.messages, fmt.Sprintf("[TOOL %s RESULT] %s", v.Name, v.Result))
+		}
+		if v.Error != "" {
+			m.messages = append(m.messages, errorStyle.Render("[Tool Error] "+v.Error))
+		}
+	case agent.Error:
+		text := "[Error] " + v.Message
+		if v.Hint != "" {
+			text += "\n  " + v.Hint
+		}
+		m.messages = append(m.messages, errorStyle.Render(text))
+	case agent.RunFinished:
+		switch v.Reason {
+		case agent.FinishAnswer:
+			m.messages = append(m.messages, "[Agent Final]: "+v.Result)
+		case agent.FinishDone:
+			m.messages = append(m.messages, "[Agent Done]: "+v.Result)
+		case agent.FinishStepLimit:
+			m.messages = append(m.messages, "[Agent] Step limit reached.")
+		case agent.FinishBudget:
+			m.messages = append(m.messages, errorStyle.Render("[Agent] budget exceeded: "+v.Budget.String()))
+		case agent.FinishCancelled:
+			m.messages = append(m.messages, "[Cancelled]")
+		}
+	case agent.DebateTurn:
+		label := fmt.Sprintf("%s · round %d", v.Name, v.Round)
+		if v.Round == 0 {
+			label = v.Name + " · opening"
+		}
+		if v.Final {
+			label = v.Name + " · verdict"
+		}
+		m.messages = append(m.messages, agentStyle.Render(strings.ToUpper(label))+": "+v.Content)
+	case agent.ApprovalRequested:
+		// Show code diff and prompt user
+		m.currentChange = codeChange{
+			filename: "(" + v.Tool + ")",
+			before:   v.Before,
+			after:    v.After,
+		}
+		m.approval = v.Reply
+		m.messages = append(m.messages, agentStyle.Render("AGENT")+": Modifier tool result. Accept (A), Edit (E), or Decline (D)?")
+		m.view = VIEW_CODE_REVIEW
+		m.textarea.Blur()
+	}
+	m.updateViewport()
+	return m, waitForStream(msg.ch, msg.final)
 }
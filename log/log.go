@@ -10,6 +10,14 @@ import (
 var logFile = "log.json"
 var mu sync.Mutex
 
+// SetFile sets where events are written, relative to the working directory
+// unless absolute. An empty path turns logging off
+func SetFile(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+	logFile = path
+}
+
 type LogEntry struct {
 	Timestamp string      `json:"timestamp"`
 	Event     string      `json:"event"`
@@ -36,6 +44,9 @@ func LogToolCall(toolName string, args interface{}, result interface{}) {
 func writeLog(entry LogEntry) {
 	mu.Lock()
 	defer mu.Unlock()
+	if logFile == "" {
+		return
+	}
 	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return
@@ -0,0 +1,222 @@
+package models
+
+import (
+	"context"
+	"spysearch/tools"
+	"strings"
+)
+
+// Anthropic Messages API support
+
+const (
+	anthropicBaseURL   = "https://api.anthropic.com"
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096
+)
+
+func init() {
+	Register("anthropic", Provider{
+		New:          func(cfg Config) CompletionInterface { return &AnthropicClient{LLM: cfg.LLM()} },
+		Capabilities: Capabilities{NativeTools: true, Vision: true},
+		Schema: []ConfigField{
+			{Name: "model", Description: "model name", Required: true},
+			{Name: "apiKey", Description: "api key", Required: true},
+			{Name: "baseURL", Description: "server url, empty uses the provider default"},
+		},
+	})
+}
+
+type AnthropicClient struct {
+	LLM
+}
+
+type AnthropicRequest struct {
+	Model     string             `json:"model"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	MaxTokens int                `json:"max_tokens"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+type AnthropicResponse struct {
+	Role       string             `json:"role"`
+	Content    []anthropicContent `json:"content"`
+	StopReason string             `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+// anthropicContent is a text, image, tool_use or tool_result block
+type anthropicContent struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     any                   `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   string                `json:"content,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"` // base64
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	InputSchema tools.ToolParameter `json:"input_schema"`
+}
+
+func (a *AnthropicClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return a.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (a *AnthropicClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return a.chat(ctx, a, msgs, tool)
+}
+
+func (a *AnthropicClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	system, messages := toAnthropicMessages(msgs)
+	maxTokens := anthropicMaxTokens
+	if a.Options.MaxTokens > 0 {
+		maxTokens = a.Options.MaxTokens
+	}
+	var anthropicresponse AnthropicResponse
+	err := a.postJSON(ctx, a.url(anthropicBaseURL, "/v1/messages"), map[string]string{
+		"X-Api-Key":         a.apiKey,
+		"Anthropic-Version": anthropicVersion,
+	}, AnthropicRequest{
+		Model:     a.Model,
+		System:    system,
+		Messages:  messages,
+		MaxTokens: maxTokens,
+		Tools:     toAnthropicTools(tool),
+
+		Temperature:   a.Options.Temperature,
+		TopP:          a.Options.TopP,
+		StopSequences: a.Options.Stop,
+	}, &anthropicresponse)
+	if err != nil {
+		return LLMMessage{}, err
+	}
+	if anthropicresponse.Error != nil {
+		return LLMMessage{}, &APIError{Provider: a.providerName(""), Kind: ErrUnknown, Message: anthropicresponse.Error.Message}
+	}
+
+	msg := fromAnthropicContent(anthropicresponse.Content)
+	msg.Usage = newUsage(anthropicresponse.Usage.InputTokens, anthropicresponse.Usage.OutputTokens)
+	return msg, nil
+}
+
+// toAnthropicMessages moves system messages into the separate system field and
+// turns tool calls and results into tool_use / tool_result blocks
+func toAnthropicMessages(msgs []LLMMessage) (string, []anthropicMessage) {
+	system := []string{}
+	out := []anthropicMessage{}
+	for _, m := range msgs {
+		role := m.Role
+		blocks := []anthropicContent{}
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "tool":
+			// tool results are sent by the user
+			role = "user"
+			blocks = append(blocks, anthropicContent{
+				Type:      "tool_result",
+				ToolUseID: m.ToolCallID,
+				Content:   m.Content,
+			})
+		default:
+			for _, img := range m.Images {
+				blocks = append(blocks, anthropicContent{Type: "image", Source: &anthropicImageSource{Type: "base64", MediaType: img.MediaType, Data: img.base64()}})
+			}
+			if m.Content != "" {
+				blocks = append(blocks, anthropicContent{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := call.Function.Arguments
+				if input == nil {
+					input = map[string]any{}
+				}
+				blocks = append(blocks, anthropicContent{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: input,
+				})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		// the api expects alternating roles, merge consecutive messages of the same role
+		if len(out) > 0 && out[len(out)-1].Role == role {
+			out[len(out)-1].Content = append(out[len(out)-1].Content, blocks...)
+			continue
+		}
+		out = append(out, anthropicMessage{Role: role, Content: blocks})
+	}
+	return strings.Join(system, "\n\n"), out
+}
+
+func toAnthropicTools(tool []tools.Tool) []anthropicTool {
+	out := []anthropicTool{}
+	for _, t := range tool {
+		schema := t.ToolFunction.Parameters
+		if schema.Type == "" {
+			schema.Type = "object"
+		}
+		if schema.Required == nil {
+			schema.Required = []string{}
+		}
+		out = append(out, anthropicTool{
+			Name:        t.ToolFunction.Name,
+			Description: t.ToolFunction.Description,
+			InputSchema: schema,
+		})
+	}
+	return out
+}
+
+func fromAnthropicContent(blocks []anthropicContent) LLMMessage {
+	msg := LLMMessage{Role: "assistant"}
+	text := []string{}
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			text = append(text, b.Text)
+		case "tool_use":
+			args, _ := b.Input.(map[string]any)
+			if args == nil {
+				args = map[string]any{}
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       b.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: b.Name, Arguments: args},
+			})
+		}
+	}
+	msg.Content = strings.Join(text, "")
+	return msg
+}
@@ -0,0 +1,81 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"spysearch/tools"
+	"testing"
+)
+
+func TestAnthropicToolRoundTrip(t *testing.T) {
+	requests := []map[string]any{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") == "" {
+			t.Errorf("missing auth headers: %v", r.Header)
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+
+		if len(requests) == 1 {
+			w.Write([]byte(`{"role":"assistant","stop_reason":"tool_use","content":[
+				{"type":"text","text":"Let me check."},
+				{"type":"tool_use","id":"toolu_1","name":"bash","input":{"command":"ls"}}]}`))
+			return
+		}
+		w.Write([]byte(`{"role":"assistant","stop_reason":"end_turn","content":[{"type":"text","text":"main.go"}]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "anthropic", Model: "claude-sonnet-4-5", APIKey: "test-key"}).(*models.AnthropicClient)
+	client.BaseURL = server.URL
+
+	bash := tools.NewBashTool().Tool
+	resp, err := client.Chat(context.Background(), []models.LLMMessage{
+		{Role: "system", Content: "You are a spy."},
+		models.UserMessage("list the files"),
+	}, []tools.Tool{bash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "Let me check." || len(resp.ToolCalls) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	call := resp.ToolCalls[0]
+	if call.ID != "toolu_1" || call.Function.Name != "bash" || call.Function.Arguments["command"] != "ls" {
+		t.Fatalf("unexpected tool call %+v", call)
+	}
+
+	first := requests[0]
+	if first["system"] != "You are a spy." {
+		t.Errorf("system prompt not moved to the system field: %v", first["system"])
+	}
+	tool := first["tools"].([]any)[0].(map[string]any)
+	if tool["name"] != "bash" || tool["input_schema"] == nil {
+		t.Errorf("unexpected tool schema %v", tool)
+	}
+
+	resp, err = client.Chat(context.Background(), []models.LLMMessage{models.ToolMessage(call, "main.go")}, []tools.Tool{bash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "main.go" {
+		t.Errorf("unexpected final answer %q", resp.Content)
+	}
+
+	// user, assistant (text + tool_use), user (tool_result)
+	msgs := requests[1]["messages"].([]any)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	result := msgs[2].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if result["type"] != "tool_result" || result["tool_use_id"] != "toolu_1" {
+		t.Errorf("unexpected tool result block %v", result)
+	}
+}
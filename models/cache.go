@@ -0,0 +1,266 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"spysearch/log"
+	"spysearch/tools"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig enables the response cache when Dir is set
+type CacheConfig struct {
+	Dir      string
+	TTL      time.Duration // zero never expires
+	MaxBytes int64         // zero is unlimited, the oldest entries are evicted first
+}
+
+// DefaultCacheDir is used when the cache is enabled without a directory
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "spysearch", "responses")
+}
+
+// ResponseCache stores replies on disk, one file per request hash
+type ResponseCache struct {
+	CacheConfig
+	mu sync.Mutex
+}
+
+// hits and misses of every cache since the process started
+var cacheHits, cacheMisses atomic.Int64
+
+type CacheStats struct {
+	Entries int
+	Bytes   int64
+	Hits    int64
+	Misses  int64
+}
+
+type cacheEntry struct {
+	Created  time.Time  `json:"created"`
+	Response LLMMessage `json:"response"`
+}
+
+func NewResponseCache(cfg CacheConfig) *ResponseCache {
+	return &ResponseCache{CacheConfig: cfg}
+}
+
+// CacheBackend is the part of a CacheKey that says who answers and how
+type CacheBackend struct {
+	Provider   string  `json:"provider"`
+	BaseURL    string  `json:"base_url"` // another server may run another build of the model
+	Model      string  `json:"model"`
+	Structured bool    `json:"structured"`
+	Options    Options `json:"options"`
+}
+
+// cacheBackend describes the backend of l for CacheKey
+func (l *LLM) cacheBackend() CacheBackend {
+	return CacheBackend{Provider: l.provider, BaseURL: l.BaseURL, Model: l.Model, Structured: l.Structured, Options: l.Options}
+}
+
+// CacheKey hashes everything that changes the reply, sampling options and
+// structured output included. Tool call ids are generated per run so they are left out
+func CacheKey(backend CacheBackend, msgs []LLMMessage, tool []tools.Tool) string {
+	stripped := make([]LLMMessage, len(msgs))
+	for i, m := range msgs {
+		m.ToolCallID = ""
+		calls := make([]ToolCall, len(m.ToolCalls))
+		for j, c := range m.ToolCalls {
+			c.ID = ""
+			calls[j] = c
+		}
+		m.ToolCalls = calls
+		stripped[i] = m
+	}
+	data, _ := json.Marshal(struct {
+		CacheBackend
+		Messages []LLMMessage `json:"messages"`
+		Tools    []tools.Tool `json:"tools"`
+	}{backend, stripped, tool})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+func (c *ResponseCache) Get(key string) (LLMMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		cacheMisses.Add(1)
+		return LLMMessage{}, false
+	}
+	var entry cacheEntry
+	if json.Unmarshal(data, &entry) != nil || (c.TTL > 0 && time.Since(entry.Created) > c.TTL) {
+		os.Remove(c.path(key))
+		cacheMisses.Add(1)
+		return LLMMessage{}, false
+	}
+	cacheHits.Add(1)
+	return entry.Response, true
+}
+
+func (c *ResponseCache) Put(key string, resp LLMMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.Marshal(cacheEntry{Created: time.Now(), Response: resp})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path(key), data, 0644); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// evict removes the oldest entries until the cache fits in MaxBytes
+func (c *ResponseCache) evict() error {
+	if c.MaxBytes <= 0 {
+		return nil
+	}
+	files, total, err := c.files()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if total <= c.MaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.Dir, f.Name())); err == nil {
+			total -= f.Size()
+		}
+	}
+	return nil
+}
+
+func (c *ResponseCache) files() ([]os.FileInfo, int64, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	return files, total, nil
+}
+
+func (c *ResponseCache) Stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, total, err := c.files()
+	return CacheStats{Entries: len(files), Bytes: total, Hits: cacheHits.Load(), Misses: cacheMisses.Load()}, err
+}
+
+// Clear removes every entry, it returns how many were removed
+func (c *ResponseCache) Clear() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, _, err := c.files()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, f := range files {
+		if os.Remove(filepath.Join(c.Dir, f.Name())) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// CachingClient answers repeated requests from a ResponseCache and sends the
+// others to Inner. A reply from the cache costs nothing, so it has no usage
+type CachingClient struct {
+	LLM
+	Inner Sender
+	Cache *ResponseCache
+}
+
+// Completion sends p as a new user message
+func (c *CachingClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return c.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (c *CachingClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return c.chat(ctx, c, msgs, tool)
+}
+
+func (c *CachingClient) CompletionStream(ctx context.Context, p string, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return c.ChatStream(ctx, []LLMMessage{UserMessage(p)}, tool, onChunk)
+}
+
+func (c *CachingClient) ChatStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return c.chatStream(ctx, c, msgs, tool, onChunk)
+}
+
+func (c *CachingClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return c.send(msgs, tool, func() (LLMMessage, error) {
+		return c.Inner.Send(ctx, msgs, tool)
+	}, nil)
+}
+
+// SendStream delivers a cached reply as a single chunk
+func (c *CachingClient) SendStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return c.send(msgs, tool, func() (LLMMessage, error) {
+		if stream, ok := c.Inner.(StreamSender); ok {
+			return stream.SendStream(ctx, msgs, tool, onChunk)
+		}
+		resp, err := c.Inner.Send(ctx, msgs, tool)
+		if err == nil && resp.Content != "" {
+			onChunk(StreamChunk{Content: resp.Content})
+		}
+		return resp, err
+	}, onChunk)
+}
+
+func (c *CachingClient) send(msgs []LLMMessage, tool []tools.Tool, miss func() (LLMMessage, error), onChunk func(StreamChunk)) (LLMMessage, error) {
+	key := CacheKey(c.cacheBackend(), msgs, tool)
+	if resp, ok := c.Cache.Get(key); ok {
+		log.LogEvent("cache_hit", key)
+		if onChunk != nil && resp.Content != "" {
+			onChunk(StreamChunk{Content: resp.Content})
+		}
+		return resp, nil
+	}
+	resp, err := miss()
+	if err != nil {
+		return resp, err
+	}
+	if err := c.Cache.Put(key, resp); err != nil {
+		log.LogEvent("cache_error", err.Error())
+	}
+	return resp, nil
+}
@@ -0,0 +1,109 @@
+package models_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"spysearch/tools"
+	"testing"
+	"time"
+)
+
+func TestCachedCompletion(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"message":{"role":"assistant","content":"cached answer"},"done":true,"prompt_eval_count":10,"eval_count":5}`))
+	}))
+	defer server.Close()
+
+	cfg := models.Config{
+		Provider: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL,
+		Cache: models.CacheConfig{Dir: t.TempDir(), TTL: time.Hour},
+	}
+	toolList := []tools.Tool{tools.NewDoneTool().Tool}
+	first, err := models.NewLLMFromConfig(cfg).Completion(context.Background(), "hi", toolList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new client with the same history is answered from disk, for free
+	second, err := models.NewLLMFromConfig(cfg).Completion(context.Background(), "hi", toolList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || second.Content != first.Content {
+		t.Errorf("expected one request, got %d and %q", calls, second.Content)
+	}
+	if first.Usage == nil || second.Usage != nil {
+		t.Errorf("only the first reply should have usage: %+v, %+v", first.Usage, second.Usage)
+	}
+
+	// other tools are another request
+	if _, err := models.NewLLMFromConfig(cfg).Completion(context.Background(), "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected a cache miss for other tools, got %d calls", calls)
+	}
+}
+
+func TestResponseCacheLimits(t *testing.T) {
+	cache := models.NewResponseCache(models.CacheConfig{Dir: t.TempDir(), TTL: time.Hour})
+	cache.Put("a", models.AssistantMessage("a"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected a hit")
+	}
+
+	cache.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("expected the entry to expire")
+	}
+
+	// every entry is about 100 bytes, only the newest fits
+	cache.TTL = 0
+	cache.MaxBytes = 150
+	cache.Put("b", models.AssistantMessage("b"))
+	time.Sleep(10 * time.Millisecond)
+	cache.Put("c", models.AssistantMessage("c"))
+	if _, ok := cache.Get("b"); ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Error("expected the newest entry to be kept")
+	}
+
+	if n, err := cache.Clear(); err != nil || n != 1 {
+		t.Errorf("expected to clear 1 entry, got %d, %v", n, err)
+	}
+	if st, _ := cache.Stats(); st.Entries != 0 {
+		t.Errorf("expected an empty cache, got %+v", st)
+	}
+}
+
+func TestCacheKeyBackend(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"message":{"role":"assistant","content":"answer"},"done":true}`))
+	}))
+	defer server.Close()
+	other := httptest.NewServer(server.Config.Handler)
+	defer other.Close()
+
+	cfg := models.Config{Provider: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL, Cache: models.CacheConfig{Dir: t.TempDir()}}
+	toolList := []tools.Tool{tools.NewDoneTool().Tool}
+	structured := cfg
+	structured.Structured = true
+	moved := cfg
+	moved.BaseURL = other.URL
+	for i, c := range []models.Config{cfg, structured, moved} {
+		if _, err := models.NewLLMFromConfig(c).Completion(context.Background(), "hi", toolList); err != nil {
+			t.Fatal(err)
+		}
+		if calls != i+1 {
+			t.Errorf("request %d was answered from the cache", i)
+		}
+	}
+}
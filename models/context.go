@@ -0,0 +1,171 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"spysearch/tools"
+	"unicode/utf8"
+)
+
+// ContextPolicy keeps the history inside the model's context window.
+// It is applied to LLM.Messages before every request
+type ContextPolicy struct {
+	Budget        int // estimated prompt tokens, 0 disables dropping messages
+	MaxToolOutput int // tool results longer than this many tokens are truncated, 0 disables
+}
+
+// EstimateTokens is a rough count (about 4 characters per token plus some
+// framing), good enough to decide what to drop without a tokenizer
+func EstimateTokens(m LLMMessage) int {
+	n := len(m.Content)
+	for _, call := range m.ToolCalls {
+		args, _ := json.Marshal(call.Function.Arguments)
+		n += len(call.Function.Name) + len(args)
+	}
+	return n/4 + 4 + len(m.Images)*imageTokens
+}
+
+func estimateAll(msgs []LLMMessage) int {
+	total := 0
+	for _, m := range msgs {
+		total += EstimateTokens(m)
+	}
+	return total
+}
+
+// estimateTools counts the tool definitions, they are sent with every request
+func estimateTools(tool []tools.Tool) int {
+	if len(tool) == 0 {
+		return 0
+	}
+	data, _ := json.Marshal(tool)
+	return len(data) / 4
+}
+
+// trim applies the context policy, the tool definitions count against the budget
+func (l *LLM) trim(tool []tools.Tool) {
+	p := l.Context
+	if p.Budget > 0 {
+		p.Budget = max(p.Budget-estimateTools(tool), 1)
+	}
+	l.Messages = TrimMessages(l.Messages, p)
+}
+
+// TrimMessages returns msgs reduced to fit p, the result is deterministic:
+//  1. tool results over MaxToolOutput, also those of fenced tool calls, are cut down to their head and tail
+//  2. the oldest conversation turns (a user message and everything after it) are dropped
+//  3. inside the last turn the oldest assistant/tool exchanges are dropped
+//
+// System messages, pinned messages, the last user message and the latest
+// exchange are always kept, so the result can still exceed the budget
+func TrimMessages(msgs []LLMMessage, p ContextPolicy) []LLMMessage {
+	out := make([]LLMMessage, len(msgs))
+	copy(out, msgs)
+
+	if p.MaxToolOutput > 0 {
+		for i := range out {
+			if (out[i].Role == "tool" || out[i].ToolOutput) && !out[i].Pinned {
+				out[i].Content = truncateMiddle(out[i].Content, p.MaxToolOutput*4)
+			}
+		}
+	}
+	if p.Budget <= 0 || len(out) == 0 || estimateAll(out) <= p.Budget {
+		return out
+	}
+
+	groups := splitGroups(out)
+	total := 0
+	for _, g := range groups {
+		total += estimateAll(g.msgs)
+	}
+	drop := func(i int) {
+		if !groups[i].keep && !groups[i].dropped {
+			groups[i].dropped = true
+			total -= estimateAll(groups[i].msgs)
+		}
+	}
+
+	lastTurn := groups[len(groups)-1].turn
+	// whole turns first so the history never starts with an orphaned assistant reply
+	for turn := 0; turn < lastTurn && total > p.Budget; turn++ {
+		for i := range groups {
+			if groups[i].turn == turn {
+				drop(i)
+			}
+		}
+	}
+	for i := range groups {
+		if total <= p.Budget {
+			break
+		}
+		if groups[i].turn == lastTurn {
+			drop(i)
+		}
+	}
+
+	result := []LLMMessage{}
+	for _, g := range groups {
+		if !g.dropped {
+			result = append(result, g.msgs...)
+		}
+	}
+	return result
+}
+
+// messageGroup is what gets dropped as a unit: a single message, or an
+// assistant message together with the results of its tool calls
+type messageGroup struct {
+	msgs    []LLMMessage
+	turn    int // -1 before the first user message
+	keep    bool
+	dropped bool
+}
+
+func splitGroups(msgs []LLMMessage) []messageGroup {
+	groups := []messageGroup{}
+	if len(msgs) == 0 {
+		return groups
+	}
+	turn := -1
+	lastUser := -1
+	for _, m := range msgs {
+		if m.Role == "user" {
+			turn++
+			lastUser = len(groups)
+		}
+		// tool results belong to the assistant message that asked for them
+		if m.Role == "tool" && len(groups) > 0 && groups[len(groups)-1].msgs[0].Role == "assistant" {
+			g := &groups[len(groups)-1]
+			g.msgs = append(g.msgs, m)
+			g.keep = g.keep || m.Pinned
+			continue
+		}
+		groups = append(groups, messageGroup{
+			msgs: []LLMMessage{m},
+			turn: turn,
+			keep: m.Role == "system" || m.Pinned || turn < 0,
+		})
+	}
+	if lastUser >= 0 {
+		groups[lastUser].keep = true
+	}
+	groups[len(groups)-1].keep = true
+	return groups
+}
+
+// truncateMiddle keeps the head and tail of s, where errors and summaries usually are
+func truncateMiddle(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	head := limit * 2 / 3
+	tail := limit - head
+	// don't cut a multi byte character in half
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	for tail > 0 && !utf8.RuneStart(s[len(s)-tail]) {
+		tail--
+	}
+	return s[:head] + fmt.Sprintf("\n...[%d characters truncated]...\n", len(s)-head-tail) + s[len(s)-tail:]
+}
@@ -0,0 +1,82 @@
+package models_test
+
+import (
+	"spysearch/models"
+	"strings"
+	"testing"
+)
+
+func exchange(name, result string) []models.LLMMessage {
+	call := models.ToolCall{ID: name, Function: models.ToolCallFunction{Name: "bash", Arguments: map[string]any{"command": name}}}
+	return []models.LLMMessage{
+		{Role: "assistant", ToolCalls: []models.ToolCall{call}},
+		models.ToolMessage(call, result),
+	}
+}
+
+func roles(msgs []models.LLMMessage) string {
+	r := []string{}
+	for _, m := range msgs {
+		r = append(r, m.Role)
+	}
+	return strings.Join(r, ",")
+}
+
+func TestTrimMessagesDropsOldestTurns(t *testing.T) {
+	filler := strings.Repeat("x", 400) // ~100 tokens
+	msgs := []models.LLMMessage{
+		{Role: "system", Content: "You are a spy."},
+		models.UserMessage("first " + filler),
+		{Role: "assistant", Content: filler},
+		{Role: "user", Content: "remember this", Pinned: true},
+		{Role: "assistant", Content: filler},
+		models.UserMessage("current task"),
+	}
+	msgs = append(msgs, exchange("a", filler)...)
+	msgs = append(msgs, exchange("b", filler)...)
+	msgs = append(msgs, exchange("c", "latest")...)
+
+	trimmed := models.TrimMessages(msgs, models.ContextPolicy{Budget: 100})
+	// the first turn is gone, the pinned turn keeps its pinned message, the
+	// last turn keeps its user message and the latest exchange
+	if got := roles(trimmed); got != "system,user,user,assistant,tool" {
+		t.Fatalf("unexpected roles %s", got)
+	}
+	if trimmed[1].Content != "remember this" || trimmed[2].Content != "current task" || trimmed[4].Content != "latest" {
+		t.Errorf("unexpected messages %+v", trimmed)
+	}
+
+	// same input, same output
+	again := models.TrimMessages(msgs, models.ContextPolicy{Budget: 100})
+	if roles(again) != roles(trimmed) {
+		t.Error("trimming is not deterministic")
+	}
+
+	if untouched := models.TrimMessages(msgs, models.ContextPolicy{}); len(untouched) != len(msgs) {
+		t.Error("a zero budget must not drop anything")
+	}
+}
+
+func TestTrimMessagesTruncatesToolOutput(t *testing.T) {
+	huge := "HEAD" + strings.Repeat("y", 10000) + "TAIL"
+	msgs := append([]models.LLMMessage{models.UserMessage("run it")}, exchange("a", huge)...)
+
+	trimmed := models.TrimMessages(msgs, models.ContextPolicy{MaxToolOutput: 100})
+	out := trimmed[2].Content
+	if len(out) > 500 || !strings.HasPrefix(out, "HEAD") || !strings.HasSuffix(out, "TAIL") || !strings.Contains(out, "truncated") {
+		t.Errorf("unexpected truncation (%d chars): %.80s", len(out), out)
+	}
+	if msgs[2].Content != huge {
+		t.Error("the input slice must not be modified")
+	}
+}
+
+func TestTrimMessagesTruncatesFencedToolResults(t *testing.T) {
+	huge := strings.Repeat("z", 10000)
+	msgs := []models.LLMMessage{models.UserMessage(huge), models.AssistantMessage("run it"), models.FencedToolResult(huge)}
+
+	trimmed := models.TrimMessages(msgs, models.ContextPolicy{MaxToolOutput: 100})
+	if len(trimmed[2].Content) > 500 || trimmed[0].Content != huge {
+		t.Errorf("only the tool result should be truncated, got %d and %d chars", len(trimmed[0].Content), len(trimmed[2].Content))
+	}
+}
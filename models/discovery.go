@@ -0,0 +1,210 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModelInfo describes a model offered by a provider, fields the api does not
+// report are left empty
+type ModelInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	ContextLength int    `json:"context_length,omitempty"`
+	Price         *Price `json:"price,omitempty"`   // USD per million tokens
+	Details       string `json:"details,omitempty"` // e.g. parameter size and quantization
+}
+
+// ModelLister is implemented by clients that can list the models of their provider
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]ModelInfo, error)
+}
+
+// ollama
+
+func (o *OllamaClient) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var tags struct {
+		Models []struct {
+			Name    string `json:"name"`
+			Details struct {
+				ParameterSize     string `json:"parameter_size"`
+				QuantizationLevel string `json:"quantization_level"`
+			} `json:"details"`
+		} `json:"models"`
+	}
+	if err := o.getJSON(ctx, o.url(ollamaBaseURL, "/api/tags"), nil, &tags); err != nil {
+		return nil, err
+	}
+	list := []ModelInfo{}
+	for _, m := range tags.Models {
+		details := strings.TrimSpace(m.Details.ParameterSize + " " + m.Details.QuantizationLevel)
+		list = append(list, ModelInfo{ID: m.Name, Details: details})
+	}
+	return list, nil
+}
+
+// openai compatible, openrouter adds context length and prices
+
+type openAIModels struct {
+	Data []struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		ContextLength int    `json:"context_length"`
+		Pricing       *struct {
+			Prompt     string `json:"prompt"`
+			Completion string `json:"completion"`
+		} `json:"pricing"`
+	} `json:"data"`
+}
+
+func (l *LLM) openAIListModels(ctx context.Context, endpoint string) ([]ModelInfo, error) {
+	var models openAIModels
+	if err := l.getJSON(ctx, endpoint, l.bearer(), &models); err != nil {
+		return nil, err
+	}
+	list := []ModelInfo{}
+	for _, m := range models.Data {
+		info := ModelInfo{ID: m.ID, Name: m.Name, ContextLength: m.ContextLength}
+		if m.Pricing != nil {
+			// openrouter prices are USD per token
+			input, err1 := strconv.ParseFloat(m.Pricing.Prompt, 64)
+			output, err2 := strconv.ParseFloat(m.Pricing.Completion, 64)
+			if err1 == nil && err2 == nil {
+				info.Price = &Price{Input: input * 1e6, Output: output * 1e6}
+			}
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func (o *OpenAIClient) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	return o.openAIListModels(ctx, o.url(openAIBaseURL, "/models"))
+}
+
+func (a *AnthropicClient) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var models struct {
+		Data []struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"display_name"`
+		} `json:"data"`
+	}
+	err := a.getJSON(ctx, a.url(anthropicBaseURL, "/v1/models?limit=1000"), map[string]string{
+		"X-Api-Key":         a.apiKey,
+		"Anthropic-Version": anthropicVersion,
+	}, &models)
+	if err != nil {
+		return nil, err
+	}
+	list := []ModelInfo{}
+	for _, m := range models.Data {
+		list = append(list, ModelInfo{ID: m.ID, Name: m.DisplayName})
+	}
+	return list, nil
+}
+
+func (g *GeminiClient) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var models struct {
+		Models []struct {
+			Name                       string   `json:"name"`
+			DisplayName                string   `json:"displayName"`
+			InputTokenLimit            int      `json:"inputTokenLimit"`
+			SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+		} `json:"models"`
+	}
+	if err := g.getJSON(ctx, g.url(geminiBaseURL, "/v1beta/models?pageSize=1000"), map[string]string{"X-Goog-Api-Key": g.apiKey}, &models); err != nil {
+		return nil, err
+	}
+	list := []ModelInfo{}
+	for _, m := range models.Models {
+		// embedding models and the like cannot chat
+		chat := false
+		for _, method := range m.SupportedGenerationMethods {
+			chat = chat || method == "generateContent"
+		}
+		if chat {
+			list = append(list, ModelInfo{ID: strings.TrimPrefix(m.Name, "models/"), Name: m.DisplayName, ContextLength: m.InputTokenLimit})
+		}
+	}
+	return list, nil
+}
+
+// ModelCache keeps the model lists on disk, so the settings screen does not
+// ask the provider every time
+type ModelCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+type modelCacheEntry struct {
+	Fetched time.Time   `json:"fetched"`
+	Models  []ModelInfo `json:"models"`
+}
+
+// DefaultModelCache lives next to the response cache and is refreshed daily
+func DefaultModelCache() ModelCache {
+	return ModelCache{Dir: filepath.Join(filepath.Dir(DefaultCacheDir()), "models"), TTL: 24 * time.Hour}
+}
+
+// the list depends on the server and on the key, e.g. fine tuned openai models
+func (c ModelCache) path(cfg Config) string {
+	sum := sha256.Sum256([]byte(cfg.Provider + "\n" + cfg.BaseURL + "\n" + cfg.APIKey))
+	return filepath.Join(c.Dir, cfg.Provider+"-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// ListModels returns the models of cfg's provider sorted by id, from the cache
+// when it is fresh unless refresh is set
+func (c ModelCache) ListModels(ctx context.Context, cfg Config, refresh bool) ([]ModelInfo, error) {
+	path := c.path(cfg)
+	if !refresh {
+		if data, err := os.ReadFile(path); err == nil {
+			var entry modelCacheEntry
+			if json.Unmarshal(data, &entry) == nil && (c.TTL <= 0 || time.Since(entry.Fetched) < c.TTL) {
+				return entry.Models, nil
+			}
+		}
+	}
+
+	cfg.Fallback, cfg.Routes, cfg.Cache = nil, nil, CacheConfig{}
+	lister, ok := NewLLMFromConfig(cfg).(ModelLister)
+	if !ok {
+		return nil, errors.New(cfg.Provider + " cannot list its models")
+	}
+	list, err := lister.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	if data, err := json.Marshal(modelCacheEntry{Fetched: time.Now(), Models: list}); err == nil {
+		os.MkdirAll(c.Dir, 0755)
+		os.WriteFile(path, data, 0644)
+	}
+	return list, nil
+}
+
+// FilterModels keeps the models whose id or name contains every word of query
+func FilterModels(list []ModelInfo, query string) []ModelInfo {
+	words := strings.Fields(strings.ToLower(query))
+	out := []ModelInfo{}
+	for _, m := range list {
+		text := strings.ToLower(m.ID + " " + m.Name)
+		match := true
+		for _, w := range words {
+			match = match && strings.Contains(text, w)
+		}
+		if match {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package models_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"testing"
+	"time"
+)
+
+func TestListOllamaModels(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != "GET" || r.URL.Path != "/api/tags" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"models":[{"name":"qwen2.5-coder:7b","details":{"parameter_size":"7.6B","quantization_level":"Q4_K_M"}},{"name":"llama3.2:3b","details":{}}]}`))
+	}))
+	defer server.Close()
+
+	cache := models.ModelCache{Dir: t.TempDir(), TTL: time.Hour}
+	cfg := models.Config{Provider: "ollama", BaseURL: server.URL}
+	list, err := cache.ListModels(context.Background(), cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "llama3.2:3b" || list[1].Details != "7.6B Q4_K_M" {
+		t.Errorf("unexpected models %+v", list)
+	}
+
+	// served from the cache until refreshed
+	cache.ListModels(context.Background(), cfg, false)
+	if calls != 1 {
+		t.Errorf("expected the cached list, got %d requests", calls)
+	}
+	cache.ListModels(context.Background(), cfg, true)
+	if calls != 2 {
+		t.Errorf("expected a refresh, got %d requests", calls)
+	}
+
+	if found := models.FilterModels(list, "QWEN 7b"); len(found) != 1 || found[0].ID != "qwen2.5-coder:7b" {
+		t.Errorf("unexpected filter result %+v", found)
+	}
+}
+
+func TestListOpenRouterModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/models" || r.Header.Get("Authorization") != "Bearer k" {
+			t.Errorf("unexpected request %s %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"data":[{"id":"openai/gpt-4o","name":"OpenAI: GPT-4o","context_length":128000,"pricing":{"prompt":"0.0000025","completion":"0.00001"}}]}`))
+	}))
+	defer server.Close()
+
+	cache := models.ModelCache{Dir: t.TempDir()}
+	list, err := cache.ListModels(context.Background(), models.Config{Provider: "openrouter", APIKey: "k", BaseURL: server.URL}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ContextLength != 128000 || list[0].Price == nil || list[0].Price.Output != 10 {
+		t.Errorf("unexpected models %+v", list)
+	}
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// EmbeddingInterface turns texts into vectors, e.g. for semantic memory or code search
+type EmbeddingInterface interface {
+	// Embed returns one vector per text, in the order of texts
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+	// Dimensions of the vectors, 0 until the first vector is known
+	Dimensions() int
+}
+
+// EmbeddingConfig picks the embedding model, the provider comes from Config
+type EmbeddingConfig struct {
+	Model      string
+	Dimensions int    // openai text-embedding-3 models can shorten their vectors, 0 keeps the default
+	BatchSize  int    // texts per request, 0 uses defaultEmbeddingBatch
+	CacheDir   string // vectors are cached on disk by content hash when set
+}
+
+const defaultEmbeddingBatch = 64
+
+// EmbedSender embeds a single batch for a provider, see Provider.NewEmbedder
+type EmbedSender interface {
+	EmbedBatch(ctx context.Context, model string, dims int, texts []string) ([][]float32, *Usage, error)
+}
+
+// Embedder batches texts, skips the ones already in its cache and keeps the usage
+type Embedder struct {
+	Config EmbeddingConfig
+	Usage  Usage
+
+	llm    *LLM
+	sender EmbedSender
+	cache  *VectorCache
+
+	mu   sync.Mutex
+	dims int
+}
+
+// NewEmbedderFromConfig embeds with the provider, base url and key of cfg
+func NewEmbedderFromConfig(cfg Config, e EmbeddingConfig) (*Embedder, error) {
+	if e.Model == "" {
+		return nil, errors.New("no embedding model configured")
+	}
+	p, ok := LookupProvider(cfg.provider())
+	if !ok || p.NewEmbedder == nil {
+		return nil, fmt.Errorf("%s has no embeddings api", cfg.provider())
+	}
+	llm := cfg.LLM()
+	embedder := &Embedder{Config: e, llm: &llm, sender: p.NewEmbedder(cfg), dims: e.Dimensions}
+	if e.CacheDir != "" {
+		embedder.cache = &VectorCache{Dir: e.CacheDir, Key: cfg.Provider + "\n" + e.Model + "\n" + strconv.Itoa(e.Dimensions)}
+	}
+	return embedder, nil
+}
+
+func (e *Embedder) Dimensions() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dims
+}
+
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	missing := []int{}
+	for i, text := range texts {
+		if v, ok := e.cache.Get(text); ok {
+			vectors[i] = v
+			continue
+		}
+		missing = append(missing, i)
+	}
+
+	batch := e.Config.BatchSize
+	if batch <= 0 {
+		batch = defaultEmbeddingBatch
+	}
+	for start := 0; start < len(missing); start += batch {
+		end := min(start+batch, len(missing))
+		inputs := []string{}
+		for _, i := range missing[start:end] {
+			inputs = append(inputs, texts[i])
+		}
+		got, usage, err := e.sender.EmbedBatch(ctx, e.Config.Model, e.Config.Dimensions, inputs)
+		if err != nil {
+			return nil, err
+		}
+		if len(got) != len(inputs) {
+			return nil, &APIError{Provider: e.llm.providerName(""), Kind: ErrUnknown, Message: fmt.Sprintf("expected %d embeddings, got %d", len(inputs), len(got))}
+		}
+		for j, i := range missing[start:end] {
+			vectors[i] = got[j]
+			e.cache.Put(texts[i], got[j])
+		}
+		if usage != nil {
+			usage.Cost = e.llm.Prices.Cost(e.Config.Model, *usage)
+			e.mu.Lock()
+			e.Usage.Add(*usage)
+			e.mu.Unlock()
+		}
+	}
+
+	if len(vectors) > 0 {
+		e.mu.Lock()
+		e.dims = len(vectors[0])
+		e.mu.Unlock()
+	}
+	return vectors, nil
+}
+
+// ollama
+
+type ollamaEmbedder struct {
+	llm *LLM
+}
+
+func newOllamaEmbedder(cfg Config) EmbedSender {
+	llm := cfg.LLM()
+	return ollamaEmbedder{&llm}
+}
+
+func (o ollamaEmbedder) EmbedBatch(ctx context.Context, model string, dims int, texts []string) ([][]float32, *Usage, error) {
+	var resp struct {
+		Embeddings      [][]float32 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+	req := map[string]any{"model": model, "input": texts}
+	if dims > 0 {
+		req["dimensions"] = dims
+	}
+	if err := o.llm.postJSON(ctx, o.llm.url(ollamaBaseURL, "/api/embed"), nil, req, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Embeddings, newUsage(resp.PromptEvalCount, 0), nil
+}
+
+// openai compatible
+
+type openAIEmbedder struct {
+	llm *LLM
+}
+
+// newOpenAIEmbedder defaults the base url like newOpenAIClient does
+func newOpenAIEmbedder(defaultBase string) func(Config) EmbedSender {
+	return func(cfg Config) EmbedSender {
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = defaultBase
+		}
+		llm := cfg.LLM()
+		return openAIEmbedder{&llm}
+	}
+}
+
+func (o openAIEmbedder) EmbedBatch(ctx context.Context, model string, dims int, texts []string) ([][]float32, *Usage, error) {
+	var resp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage *openAIUsage `json:"usage"`
+	}
+	req := map[string]any{"model": model, "input": texts}
+	if dims > 0 {
+		req["dimensions"] = dims
+	}
+	if err := o.llm.postJSON(ctx, o.llm.url("", "/embeddings"), o.llm.bearer(), req, &resp); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(resp.Data, func(i, j int) bool { return resp.Data[i].Index < resp.Data[j].Index })
+	vectors := [][]float32{}
+	for _, d := range resp.Data {
+		vectors = append(vectors, d.Embedding)
+	}
+	var usage *Usage
+	if resp.Usage != nil {
+		usage = newUsage(resp.Usage.PromptTokens, 0)
+	}
+	return vectors, usage, nil
+}
+
+// VectorCache stores vectors as little endian float32 files named by the hash
+// of Key and the text, Key separates models and dimensions. A nil cache stores nothing
+type VectorCache struct {
+	Dir string
+	Key string
+}
+
+func (c *VectorCache) path(text string) string {
+	sum := sha256.Sum256([]byte(c.Key + "\n" + text))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".vec")
+}
+
+func (c *VectorCache) Get(text string) ([]float32, bool) {
+	if c == nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(text))
+	if err != nil || len(data) == 0 || len(data)%4 != 0 {
+		return nil, false
+	}
+	v := make([]float32, len(data)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return v, true
+}
+
+func (c *VectorCache) Put(text string, v []float32) error {
+	if c == nil {
+		return nil
+	}
+	data := make([]byte, len(v)*4)
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(f))
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(text), data, 0644)
+}
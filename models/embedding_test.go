@@ -0,0 +1,138 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"testing"
+)
+
+func TestOllamaEmbeddings(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/embed" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := map[string]any{"prompt_eval_count": len(req.Input)}
+		vectors := [][]float32{}
+		for _, text := range req.Input {
+			vectors = append(vectors, []float32{float32(len(text)), 0.5, -1})
+		}
+		resp["embeddings"] = vectors
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	var embedder models.EmbeddingInterface
+	e, err := models.NewEmbedderFromConfig(models.Config{Provider: "ollama", BaseURL: server.URL},
+		models.EmbeddingConfig{Model: "nomic-embed-text", BatchSize: 2, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder = e
+
+	texts := []string{"a", "bb", "ccc"}
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || len(vectors) != 3 || vectors[2][0] != 3 || embedder.Dimensions() != 3 {
+		t.Fatalf("unexpected vectors %v after %d requests", vectors, requests)
+	}
+	if e.Usage.PromptTokens != 3 {
+		t.Errorf("unexpected usage %+v", e.Usage)
+	}
+
+	// cached vectors are not requested again, only the new text is
+	vectors, err = embedder.Embed(context.Background(), []string{"bb", "dddd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 || vectors[0][0] != 2 || vectors[0][1] != 0.5 || vectors[1][0] != 4 {
+		t.Errorf("unexpected vectors %v after %d requests", vectors, requests)
+	}
+}
+
+func TestOpenAIEmbeddings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/embeddings" || req["dimensions"] != 2.0 {
+			t.Errorf("unexpected request %s %v", r.URL.Path, req)
+		}
+		// the data may come back in any order
+		w.Write([]byte(`{"data":[{"index":1,"embedding":[0,1]},{"index":0,"embedding":[1,0]}],"usage":{"prompt_tokens":4,"total_tokens":4}}`))
+	}))
+	defer server.Close()
+
+	e, err := models.NewEmbedderFromConfig(models.Config{Provider: "openai", APIKey: "k", BaseURL: server.URL},
+		models.EmbeddingConfig{Model: "text-embedding-3-small", Dimensions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := e.Embed(context.Background(), []string{"first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vectors[0][0] != 1 || vectors[1][1] != 1 || e.Usage.PromptTokens != 4 {
+		t.Errorf("unexpected vectors %v, usage %+v", vectors, e.Usage)
+	}
+
+	// openrouter speaks the same api
+	e, err = models.NewEmbedderFromConfig(models.Config{Provider: "openrouter", APIKey: "k", BaseURL: server.URL},
+		models.EmbeddingConfig{Model: "openai/text-embedding-3-small", Dimensions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Embed(context.Background(), []string{"first", "second"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := models.NewEmbedderFromConfig(models.Config{Provider: "anthropic"}, models.EmbeddingConfig{Model: "x"}); err == nil {
+		t.Error("expected an error for a provider without embeddings")
+	}
+}
+
+// lengthSender embeds a text as its length, for a provider registered from outside the package
+type lengthSender struct{}
+
+func (lengthSender) EmbedBatch(ctx context.Context, model string, dims int, texts []string) ([][]float32, *models.Usage, error) {
+	vectors := [][]float32{}
+	for _, text := range texts {
+		vectors = append(vectors, []float32{float32(len(text))})
+	}
+	return vectors, nil, nil
+}
+
+func init() {
+	models.Register("lengths", models.Provider{
+		New:         func(cfg models.Config) models.CompletionInterface { return nil },
+		NewEmbedder: func(cfg models.Config) models.EmbedSender { return lengthSender{} },
+	})
+}
+
+func TestRegisteredEmbeddings(t *testing.T) {
+	e, err := models.NewEmbedderFromConfig(models.Config{Provider: "lengths"}, models.EmbeddingConfig{Model: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors, err := e.Embed(context.Background(), []string{"abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 1 || vectors[0][0] != 3 {
+		t.Errorf("unexpected vectors %v", vectors)
+	}
+
+	// echo has no embeddings api
+	if _, err := models.NewEmbedderFromConfig(models.Config{Provider: "echo"}, models.EmbeddingConfig{Model: "x"}); err == nil {
+		t.Error("expected an error for a provider without NewEmbedder")
+	}
+}
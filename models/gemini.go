@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"spysearch/tools"
+	"strings"
+)
+
+// Google Gemini generateContent support
+
+const geminiBaseURL = "https://generativelanguage.googleapis.com"
+
+func init() {
+	Register("gemini", Provider{
+		New:          func(cfg Config) CompletionInterface { return &GeminiClient{LLM: cfg.LLM()} },
+		Capabilities: Capabilities{NativeTools: true, Vision: true},
+		Schema: []ConfigField{
+			{Name: "model", Description: "model name", Required: true},
+			{Name: "apiKey", Description: "api key", Required: true},
+			{Name: "baseURL", Description: "server url, empty uses the provider default"},
+		},
+	})
+}
+
+type GeminiClient struct {
+	LLM
+}
+
+type GeminiRequest struct {
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent `json:"contents"`
+	Tools             []geminiTool    `json:"tools,omitempty"`
+	GenerationConfig  *geminiConfig   `json:"generationConfig,omitempty"`
+}
+
+type geminiConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+func (o Options) gemini() *geminiConfig {
+	if o.Temperature == nil && o.TopP == nil && o.Seed == nil && o.MaxTokens == 0 && len(o.Stop) == 0 {
+		return nil
+	}
+	return &geminiConfig{Temperature: o.Temperature, TopP: o.TopP, Seed: o.Seed, MaxOutputTokens: o.MaxTokens, StopSequences: o.Stop}
+}
+
+type GeminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // base64
+}
+
+type geminiFunctionCall struct {
+	ID   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Parameters  *geminiSchema `json:"parameters,omitempty"`
+}
+
+// geminiSchema is the OpenAPI subset accepted by functionDeclarations
+type geminiSchema struct {
+	Type        string                   `json:"type"`
+	Description string                   `json:"description,omitempty"`
+	Properties  map[string]*geminiSchema `json:"properties,omitempty"`
+	Required    []string                 `json:"required,omitempty"`
+	Items       *geminiSchema            `json:"items,omitempty"`
+}
+
+func (g *GeminiClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return g.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (g *GeminiClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return g.chat(ctx, g, msgs, tool)
+}
+
+func (g *GeminiClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	system, contents := toGeminiContents(msgs)
+	endpoint := g.url(geminiBaseURL, "/v1beta/models/"+url.PathEscape(g.Model)+":generateContent")
+	var geminiresponse GeminiResponse
+	err := g.postJSON(ctx, endpoint, map[string]string{"X-Goog-Api-Key": g.apiKey}, GeminiRequest{
+		SystemInstruction: system,
+		Contents:          contents,
+		Tools:             toGeminiTools(tool),
+		GenerationConfig:  g.Options.gemini(),
+	}, &geminiresponse)
+	if err != nil {
+		return LLMMessage{}, err
+	}
+	if geminiresponse.Error != nil {
+		return LLMMessage{}, &APIError{Provider: g.providerName(endpoint), Kind: ErrUnknown, StatusCode: geminiresponse.Error.Code, Message: geminiresponse.Error.Message}
+	}
+	// a prompt blocked by safety filters comes back without candidates
+	if len(geminiresponse.Candidates) == 0 {
+		return LLMMessage{}, &APIError{Provider: g.providerName(endpoint), Kind: ErrUnknown, Message: "no candidates returned"}
+	}
+
+	msg := fromGeminiContent(geminiresponse.Candidates[0].Content)
+	msg.Usage = newUsage(geminiresponse.UsageMetadata.PromptTokenCount, geminiresponse.UsageMetadata.CandidatesTokenCount)
+	return msg, nil
+}
+
+// toGeminiContents maps roles to user/model, tool calls to functionCall parts and
+// tool results to functionResponse parts which gemini links by function name
+func toGeminiContents(msgs []LLMMessage) (*geminiContent, []geminiContent) {
+	var system *geminiContent
+	out := []geminiContent{}
+	for _, m := range msgs {
+		role := "user"
+		parts := []geminiPart{}
+		switch m.Role {
+		case "system":
+			if system == nil {
+				system = &geminiContent{}
+			}
+			system.Parts = append(system.Parts, geminiPart{Text: m.Content})
+			continue
+		case "tool":
+			parts = append(parts, geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     m.ToolName,
+				Response: map[string]any{"result": m.Content},
+			}})
+		case "assistant":
+			role = "model"
+			fallthrough
+		default:
+			if m.Content != "" {
+				parts = append(parts, geminiPart{Text: m.Content})
+			}
+			for _, img := range m.Images {
+				parts = append(parts, geminiPart{InlineData: &geminiBlob{MimeType: img.MediaType, Data: img.base64()}})
+			}
+			for _, call := range m.ToolCalls {
+				args := call.Function.Arguments
+				if args == nil {
+					args = map[string]any{}
+				}
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: call.Function.Name,
+					Args: args,
+				}})
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1].Role == role {
+			out[len(out)-1].Parts = append(out[len(out)-1].Parts, parts...)
+			continue
+		}
+		out = append(out, geminiContent{Role: role, Parts: parts})
+	}
+	return system, out
+}
+
+func toGeminiTools(tool []tools.Tool) []geminiTool {
+	if len(tool) == 0 {
+		return nil
+	}
+	declarations := []geminiFunctionDeclaration{}
+	for _, t := range tool {
+		declarations = append(declarations, geminiFunctionDeclaration{
+			Name:        t.ToolFunction.Name,
+			Description: t.ToolFunction.Description,
+			Parameters:  toGeminiSchema(t.ToolFunction.Parameters),
+		})
+	}
+	return []geminiTool{{FunctionDeclarations: declarations}}
+}
+
+// toGeminiSchema converts a tool parameter into gemini's schema subset, gemini
+// rejects objects without properties so those are left out entirely
+func toGeminiSchema(p tools.ToolParameter) *geminiSchema {
+	if len(p.Properties) == 0 {
+		return nil
+	}
+	schema := &geminiSchema{
+		Type:       "OBJECT",
+		Properties: map[string]*geminiSchema{},
+		Required:   p.Required,
+	}
+	for name, prop := range p.Properties {
+		s := &geminiSchema{
+			Type:        geminiType(prop.Type),
+			Description: prop.Description,
+		}
+		// arrays need an item type, the tool definitions don't carry one
+		if s.Type == "ARRAY" {
+			s.Items = &geminiSchema{Type: "STRING"}
+		}
+		schema.Properties[name] = s
+	}
+	return schema
+}
+
+func geminiType(t string) string {
+	switch strings.ToLower(t) {
+	case "integer":
+		return "INTEGER"
+	case "number":
+		return "NUMBER"
+	case "boolean":
+		return "BOOLEAN"
+	case "array":
+		return "ARRAY"
+	case "object":
+		return "OBJECT"
+	default:
+		return "STRING"
+	}
+}
+
+func fromGeminiContent(content geminiContent) LLMMessage {
+	msg := LLMMessage{Role: "assistant"}
+	text := []string{}
+	for _, part := range content.Parts {
+		if part.FunctionCall != nil {
+			args := part.FunctionCall.Args
+			if args == nil {
+				args = map[string]any{}
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       part.FunctionCall.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: part.FunctionCall.Name, Arguments: args},
+			})
+			continue
+		}
+		text = append(text, part.Text)
+	}
+	msg.Content = strings.Join(text, "")
+	return msg
+}
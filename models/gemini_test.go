@@ -0,0 +1,73 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"spysearch/tools"
+	"testing"
+)
+
+func TestGeminiToolRoundTrip(t *testing.T) {
+	requests := []map[string]any{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1beta/models/gemini-2.5-flash:generateContent" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-goog-api-key") != "test-key" {
+			t.Errorf("missing api key header")
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+
+		if len(requests) == 1 {
+			w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"done","args":{"message":"finished"}}}]}}]}`))
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"All done."}]}}]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "gemini", Model: "gemini-2.5-flash", APIKey: "test-key"}).(*models.GeminiClient)
+	client.BaseURL = server.URL
+
+	done := tools.NewDoneTool().Tool
+	resp, err := client.Chat(context.Background(), []models.LLMMessage{
+		{Role: "system", Content: "Be brief."},
+		models.UserMessage("finish"),
+	}, []tools.Tool{done, tools.NewThinkingTool().Tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Arguments["message"] != "finished" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	first := requests[0]
+	if first["systemInstruction"] == nil {
+		t.Error("system message not sent as systemInstruction")
+	}
+	decls := first["tools"].([]any)[0].(map[string]any)["functionDeclarations"].([]any)
+	params := decls[0].(map[string]any)["parameters"].(map[string]any)
+	message := params["properties"].(map[string]any)["message"].(map[string]any)
+	if params["type"] != "OBJECT" || message["type"] != "STRING" {
+		t.Errorf("unexpected schema %v", params)
+	}
+
+	if _, err := client.Chat(context.Background(), []models.LLMMessage{models.ToolMessage(resp.ToolCalls[0], "finished")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	contents := requests[1]["contents"].([]any)
+	last := contents[len(contents)-1].(map[string]any)
+	part := last["parts"].([]any)[0].(map[string]any)
+	fr, ok := part["functionResponse"].(map[string]any)
+	if !ok || fr["name"] != "done" || last["role"] != "user" {
+		t.Errorf("unexpected function response %v", last)
+	}
+	if contents[1].(map[string]any)["role"] != "model" {
+		t.Errorf("assistant turn should use the model role")
+	}
+}
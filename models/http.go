@@ -0,0 +1,327 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorKind classifies a failed provider call so callers can react to it
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	ErrAuth
+	ErrRateLimit
+	ErrContextLength
+	ErrServer
+	ErrNetwork
+	ErrBadRequest
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrAuth:
+		return "auth"
+	case ErrRateLimit:
+		return "rate limit"
+	case ErrContextLength:
+		return "context length"
+	case ErrServer:
+		return "server"
+	case ErrNetwork:
+		return "network"
+	case ErrBadRequest:
+		return "bad request"
+	default:
+		return "unknown"
+	}
+}
+
+// APIError is returned by every provider call that did not produce a usable answer
+type APIError struct {
+	Provider   string
+	Kind       ErrorKind
+	StatusCode int // 0 when the request never got a response
+	Message    string
+	RetryAfter time.Duration // what the server asked us to wait, if anything
+	Err        error         // underlying transport error
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" && e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: %s error (%d): %s", e.Provider, e.Kind, e.StatusCode, msg)
+	}
+	return fmt.Sprintf("%s: %s error: %s", e.Provider, e.Kind, msg)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether sending the same request again may succeed
+func (e *APIError) Retryable() bool {
+	return e.Kind == ErrRateLimit || e.Kind == ErrServer || e.Kind == ErrNetwork
+}
+
+// ErrorKindOf returns the kind of an APIError anywhere in err's chain
+func ErrorKindOf(err error) ErrorKind {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Kind
+	}
+	return ErrUnknown
+}
+
+// ErrorHint is a short suggestion for the user on how to fix err
+func ErrorHint(err error) string {
+	switch ErrorKindOf(err) {
+	case ErrAuth:
+		return "check the API key in \\settings"
+	case ErrRateLimit:
+		return "rate limited by the provider, wait a moment or switch model"
+	case ErrContextLength:
+		return "the conversation is too long for this model, use \\clear or a model with a larger context"
+	case ErrServer:
+		return "the provider is having problems, try again later"
+	case ErrNetwork:
+		return "could not reach the provider, check the base URL and that the server is running"
+	case ErrBadRequest:
+		return "the provider rejected the request, check the model name"
+	}
+	return ""
+}
+
+// RetryPolicy controls how transient failures are retried
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// delay is a jittered exponential backoff, a server provided Retry-After wins
+// when longer, up to MaxDelay
+func (p RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if p.MaxDelay > 0 && retryAfter > p.MaxDelay {
+		retryAfter = p.MaxDelay
+	}
+	d := p.BaseDelay << attempt
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if retryAfter > d {
+		return retryAfter
+	}
+	return d
+}
+
+// post sends body as json and retries classified transient failures.
+// On success the caller owns the response body, which lets streaming read it incrementally
+func (l *LLM) post(ctx context.Context, endpoint string, headers map[string]string, body any) (*http.Response, error) {
+	return l.request(ctx, "POST", endpoint, headers, body)
+}
+
+// request is post for any method, a nil body sends none
+func (l *LLM) request(ctx context.Context, method, endpoint string, headers map[string]string, body any) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			slog.Error("Marshal err")
+			slog.Error(err.Error())
+			return nil, err
+		}
+	}
+
+	policy := l.Retry
+	if policy.MaxAttempts == 0 {
+		policy = DefaultRetryPolicy
+	}
+
+	var apiErr *APIError
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := policy.delay(attempt-1, apiErr.RetryAfter)
+			slog.Warn("retrying provider request", "provider", apiErr.Provider, "kind", apiErr.Kind.String(), "wait", wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		r, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+
+		c := http.Client{}
+		res, err := c.Do(r)
+		if err != nil {
+			// a cancelled run is not a network problem and must not be retried
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			apiErr = &APIError{Provider: l.providerName(endpoint), Kind: ErrNetwork, Err: err}
+			continue
+		}
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return res, nil
+		}
+
+		apiErr = l.classify(endpoint, res)
+		res.Body.Close()
+		if !apiErr.Retryable() {
+			break
+		}
+	}
+	return nil, apiErr
+}
+
+// postJSON is post for non streaming calls, the response is decoded into out
+func (l *LLM) postJSON(ctx context.Context, endpoint string, headers map[string]string, body any, out any) error {
+	return l.requestJSON(ctx, "POST", endpoint, headers, body, out)
+}
+
+// getJSON decodes the response of a GET on endpoint into out
+func (l *LLM) getJSON(ctx context.Context, endpoint string, headers map[string]string, out any) error {
+	return l.requestJSON(ctx, "GET", endpoint, headers, nil, out)
+}
+
+func (l *LLM) requestJSON(ctx context.Context, method, endpoint string, headers map[string]string, body any, out any) error {
+	res, err := l.request(ctx, method, endpoint, headers, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	responsebody, err := io.ReadAll(res.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &APIError{Provider: l.providerName(endpoint), Kind: ErrNetwork, Err: err}
+	}
+	if err := json.Unmarshal(responsebody, out); err != nil {
+		return &APIError{Provider: l.providerName(endpoint), Kind: ErrUnknown, StatusCode: res.StatusCode, Message: "invalid response: " + err.Error()}
+	}
+	return nil
+}
+
+func (l *LLM) providerName(endpoint string) string {
+	if l.provider != "" {
+		return l.provider
+	}
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "provider"
+}
+
+// classify turns a non 2xx response into an APIError
+func (l *LLM) classify(endpoint string, res *http.Response) *APIError {
+	raw, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	apiErr := &APIError{
+		Provider:   l.providerName(endpoint),
+		StatusCode: res.StatusCode,
+		Message:    errorMessage(raw),
+		RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+	}
+
+	lower := strings.ToLower(apiErr.Message)
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		apiErr.Kind = ErrAuth
+	case res.StatusCode == http.StatusTooManyRequests:
+		apiErr.Kind = ErrRateLimit
+	case res.StatusCode == http.StatusRequestEntityTooLarge || isContextLengthMessage(lower):
+		apiErr.Kind = ErrContextLength
+	case res.StatusCode >= 500:
+		apiErr.Kind = ErrServer
+	case res.StatusCode >= 400:
+		apiErr.Kind = ErrBadRequest
+	}
+	return apiErr
+}
+
+func isContextLengthMessage(msg string) bool {
+	for _, s := range []string{"context length", "context_length", "context window", "maximum context", "too many tokens", "prompt is too long", "exceeds the maximum"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorMessage digs the message out of the error bodies the providers send:
+// {"error":{"message":...}} (openai, anthropic, gemini) or {"error":"..."} (ollama)
+func errorMessage(raw []byte) string {
+	var body struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &body); err == nil {
+		var s string
+		if json.Unmarshal(body.Error, &s) == nil && s != "" {
+			return s
+		}
+		var obj struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body.Error, &obj) == nil && obj.Message != "" {
+			return obj.Message
+		}
+		if body.Message != "" {
+			return body.Message
+		}
+	}
+	msg := strings.TrimSpace(string(raw))
+	if len(msg) > 300 {
+		msg = msg[:300] + "..."
+	}
+	return msg
+}
+
+// retryAfter parses the Retry-After header, either seconds or an http date
+func retryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
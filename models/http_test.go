@@ -0,0 +1,114 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"testing"
+	"time"
+)
+
+var fastRetry = models.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"slow down"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openai", Model: "gpt-4o", APIKey: "k", BaseURL: server.URL}).(*models.OpenAIClient)
+	client.Retry = fastRetry
+	resp, err := client.Completion(context.Background(), "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "hi" || calls != 2 {
+		t.Errorf("expected a retried success, got %q after %d calls", resp.Content, calls)
+	}
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openai", Model: "gpt-4o", APIKey: "k", BaseURL: server.URL, Retry: fastRetry})
+	start := time.Now()
+	if _, err := client.Completion(context.Background(), "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %s, more than MaxDelay", waited)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		kind   models.ErrorKind
+		calls  int
+	}{
+		{http.StatusUnauthorized, `{"error":{"message":"Incorrect API key"}}`, models.ErrAuth, 1},
+		{http.StatusBadRequest, `{"error":{"message":"This model's maximum context length is 8192 tokens"}}`, models.ErrContextLength, 1},
+		{http.StatusNotFound, `{"error":"model 'qwen' not found"}`, models.ErrBadRequest, 1},
+		{http.StatusServiceUnavailable, `overloaded`, models.ErrServer, 3},
+	}
+	for _, c := range cases {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+
+		client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen", BaseURL: server.URL}).(*models.OllamaClient)
+		client.Retry = fastRetry
+		_, err := client.Completion(context.Background(), "hello", nil)
+		server.Close()
+
+		var apiErr *models.APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%d: expected an APIError, got %v", c.status, err)
+		}
+		if apiErr.Kind != c.kind || apiErr.StatusCode != c.status {
+			t.Errorf("%d: expected %s, got %s", c.status, c.kind, apiErr.Kind)
+		}
+		if calls != c.calls {
+			t.Errorf("%d: expected %d attempts, got %d", c.status, c.calls, calls)
+		}
+		if models.ErrorHint(err) == "" {
+			t.Errorf("%d: expected a hint", c.status)
+		}
+	}
+}
+
+func TestEmptyChoicesIsAnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openrouter", Model: "x", BaseURL: server.URL})
+	if _, err := client.Completion(context.Background(), "hello", nil); err == nil {
+		t.Error("expected an error for a response without choices")
+	}
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Image is a picture attached to a user message. It is sent base64 encoded,
+// as a json string, which is also what ollama expects in `images`
+type Image struct {
+	MediaType string // e.g. image/png
+	Data      []byte
+}
+
+// maxImageBytes is below the limits of the hosted providers
+const maxImageBytes = 20 << 20
+
+// imageTokens is a rough cost of an image, providers count them by size
+const imageTokens = 800
+
+// ErrNoVision is returned when images are sent to a provider without vision
+var ErrNoVision = errors.New("this provider cannot read images")
+
+// LoadImage reads a png, jpeg, gif or webp file
+func LoadImage(path string) (Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Image{}, err
+	}
+	if len(data) > maxImageBytes {
+		return Image{}, fmt.Errorf("%s is larger than %d MB", path, maxImageBytes>>20)
+	}
+	img := Image{MediaType: http.DetectContentType(data), Data: data}
+	if !img.supported() {
+		return Image{}, fmt.Errorf("%s is not a png, jpeg, gif or webp image (%s)", path, img.MediaType)
+	}
+	return img, nil
+}
+
+func (i Image) supported() bool {
+	switch i.MediaType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+func (i Image) base64() string {
+	return base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// dataURI is how openai compatible apis take images
+func (i Image) dataURI() string {
+	return "data:" + i.MediaType + ";base64," + i.base64()
+}
+
+func (i Image) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.base64())
+}
+
+// UnmarshalJSON reads the base64 string back, the media type is sniffed again
+func (i *Image) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return err
+	}
+	*i = Image{MediaType: http.DetectContentType(decoded), Data: decoded}
+	return nil
+}
+
+// checkImages refuses msgs carrying images when the provider has no vision,
+// before anything is added to the history
+func (l *LLM) checkImages(msgs []LLMMessage) error {
+	if l.Capabilities().Vision {
+		return nil
+	}
+	for _, m := range msgs {
+		if len(m.Images) > 0 {
+			return fmt.Errorf("%s: %w, pick a vision model to send images", l.providerName(""), ErrNoVision)
+		}
+	}
+	return nil
+}
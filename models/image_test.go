@@ -0,0 +1,99 @@
+package models_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"spysearch/models"
+	"testing"
+)
+
+// a 1x1 png
+var pixel, _ = base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mP8z8BQDwAEhQGAhKmMIQAAAABJRU5ErkJggg==")
+
+// capture answers every request with reply and keeps the decoded body
+func capture(reply string, body *map[string]any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(body)
+		w.Write([]byte(reply))
+	}))
+}
+
+func loadPixel(t *testing.T) models.Image {
+	path := filepath.Join(t.TempDir(), "pixel.png")
+	os.WriteFile(path, pixel, 0644)
+	img, err := models.LoadImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.MediaType != "image/png" {
+		t.Fatalf("unexpected media type %q", img.MediaType)
+	}
+	return img
+}
+
+func TestLoadImageRejectsText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.png")
+	os.WriteFile(path, []byte("not an image"), 0644)
+	if _, err := models.LoadImage(path); err == nil {
+		t.Error("expected an error for a text file")
+	}
+}
+
+func TestImagesPerProvider(t *testing.T) {
+	img := loadPixel(t)
+	encoded := base64.StdEncoding.EncodeToString(pixel)
+	msg := models.LLMMessage{Role: "user", Content: "what is this?", Images: []models.Image{img}}
+
+	cases := []struct {
+		provider string
+		reply    string
+		check    func(body map[string]any) bool
+	}{
+		{"ollama", `{"message":{"role":"assistant","content":"a pixel"},"done":true}`, func(body map[string]any) bool {
+			m := body["messages"].([]any)[0].(map[string]any)
+			return m["images"].([]any)[0] == encoded && m["content"] == "what is this?"
+		}},
+		{"openai", `{"choices":[{"message":{"role":"assistant","content":"a pixel"}}]}`, func(body map[string]any) bool {
+			parts := body["messages"].([]any)[0].(map[string]any)["content"].([]any)
+			url := parts[1].(map[string]any)["image_url"].(map[string]any)["url"]
+			return parts[0].(map[string]any)["text"] == "what is this?" && url == "data:image/png;base64,"+encoded
+		}},
+		{"anthropic", `{"role":"assistant","content":[{"type":"text","text":"a pixel"}]}`, func(body map[string]any) bool {
+			block := body["messages"].([]any)[0].(map[string]any)["content"].([]any)[0].(map[string]any)
+			source := block["source"].(map[string]any)
+			return block["type"] == "image" && source["media_type"] == "image/png" && source["data"] == encoded
+		}},
+	}
+	for _, c := range cases {
+		var body map[string]any
+		server := capture(c.reply, &body)
+		client := models.NewLLMFromConfig(models.Config{Provider: c.provider, Model: "vision", APIKey: "key", BaseURL: server.URL})
+		resp, err := client.Chat(context.Background(), []models.LLMMessage{msg}, nil)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %v", c.provider, err)
+			continue
+		}
+		if resp.Content != "a pixel" || !c.check(body) {
+			t.Errorf("%s: unexpected request %v", c.provider, body)
+		}
+	}
+}
+
+func TestImagesNeedVision(t *testing.T) {
+	img := loadPixel(t)
+	client := models.NewLLMFromConfig(models.Config{Provider: "replay", Cassette: filepath.Join(t.TempDir(), "none.json")}).(*models.ReplayClient)
+	_, err := client.Chat(context.Background(), []models.LLMMessage{{Role: "user", Content: "what is this?", Images: []models.Image{img}}}, nil)
+	if !errors.Is(err, models.ErrNoVision) {
+		t.Fatalf("expected ErrNoVision, got %v", err)
+	}
+	if len(client.Messages) != 0 {
+		t.Errorf("rejected images should not enter the history: %+v", client.Messages)
+	}
+}
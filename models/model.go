@@ -1,13 +1,24 @@
 package models
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"io"
-	"log/slog"
-	"net/http"
+	"fmt"
+	"maps"
+	"spysearch/log"
 	"spysearch/tools"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// default endpoints, every provider can be pointed somewhere else with Config.BaseURL
+const (
+	ollamaBaseURL           = "http://localhost:11434"
+	openAIBaseURL           = "https://api.openai.com/v1"
+	openRouterBaseURL       = "https://openrouter.ai/api/v1"
+	openAICompatibleBaseURL = "http://localhost:8000/v1"
 )
 
 // here we first focusing on ollama at first version
@@ -15,160 +26,273 @@ type LLM struct {
 	Model    string
 	apiKey   string
 	provider string
+	BaseURL  string      // empty uses the provider default
+	Retry    RetryPolicy // zero value uses DefaultRetryPolicy
+	Prices   PriceTable
+	Context  ContextPolicy
+	// Structured forces tool calls as json for models without native tool calling, see ToolCallSchema
+	Structured bool
+	Options    Options // sampling parameters
+	caps       Capabilities
 
 	Messages []LLMMessage
+	Usage    Usage // every call made by this client
+}
+
+// url joins the configured base url (or defaultBase) with path
+func (l *LLM) url(defaultBase, path string) string {
+	base := l.BaseURL
+	if base == "" {
+		base = defaultBase
+	}
+	return strings.TrimRight(base, "/") + path
 }
 
 // LLMMessage (maybe we shall split into seperate folder)
 type LLMMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"` // set on role "tool" messages
+	ToolName   string     `json:"tool_name,omitempty"`    // ollama links tool results by name
+	Images     []Image    `json:"images,omitempty"`       // user messages only, see LoadImage
+	Thinking   string     `json:"thinking,omitempty"`     // reasoning of the model before its reply, when the provider shows it
+
+	Usage      *Usage `json:"-"` // set on replies when the provider reports it
+	Pinned     bool   `json:"-"` // never dropped when the history is trimmed
+	ToolOutput bool   `json:"-"` // a tool result in a user message, truncated like tool messages
+	Model      string `json:"-"` // set by a Router to the model of the backend that answered
 }
 
-// list of LLM Messages
-type LLMMessages []LLMMessage
+func UserMessage(content string) LLMMessage {
+	return LLMMessage{Role: "user", Content: content}
+}
 
-// The completion interface should be provided as an abstraction to every model
-// This is useful to check
-type CompletionInterface interface {
-	Completion(p string, tool []tools.Tool) (LLMMessage, error)
+// ToolMessage is the result of call sent back to the model
+func ToolMessage(call ToolCall, content string) LLMMessage {
+	return LLMMessage{
+		Role:       "tool",
+		Content:    content,
+		ToolCallID: call.ID,
+		ToolName:   call.Function.Name,
+	}
 }
 
-// Currently let's handle ollama and open router first
-type OllamaClient struct {
-	LLM
+// FencedToolResult is the result of a fenced json tool call, models without
+// native tool calls get it as a user message
+func FencedToolResult(content string) LLMMessage {
+	return LLMMessage{Role: "user", Content: content, ToolOutput: true}
 }
 
-type OllamaRequest struct {
-	Model    string       `json:"model"`
-	Messages []LLMMessage `json:"messages"`
-	Stream   bool         `json:"stream"`
-	Tools    []tools.Tool `json:"tools"`
+// ToolCall is a native tool call returned by ollama or openai
+type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
 }
 
-type OllamaResponse struct {
-	Model   string     `json:"model"`
-	Create  string     `json:"created_at"`
-	Message LLMMessage `json:"message"`
-	Done    bool       `json:"done"`
+type ToolCallFunction struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+
+	ArgumentsError string `json:"-"` // the arguments were not valid json, Arguments is empty
 }
 
-// ollama completion logic the completion should be a tool call
-func (o *OllamaClient) Completion(p string, tool []tools.Tool) (LLMMessage, error) {
-	message := LLMMessage{
-		Role:    "user",
-		Content: p,
+// UnmarshalJSON accepts both ollama (json object) and openai (json encoded string) arguments.
+// Arguments that cannot be decoded keep the call, with ArgumentsError set
+func (f *ToolCallFunction) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
 	}
-	o.Messages = append(o.Messages, message)
-
-	body, err := json.Marshal(OllamaRequest{
-		Model:    o.Model,
-		Messages: o.Messages,
-		Stream:   false,
-		Tools:    tool,
-	})
-	if err != nil {
-		slog.Error("Marshal err")
-		slog.Error(err.Error())
-		return LLMMessage{}, err
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	f.Name = raw.Name
+	f.Arguments = map[string]any{}
+
+	args := bytes.TrimSpace(raw.Arguments)
+	if len(args) > 0 && args[0] == '"' {
+		var encoded string
+		if err := json.Unmarshal(args, &encoded); err != nil {
+			return err
+		}
+		args = []byte(strings.TrimSpace(encoded))
 	}
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(args, &f.Arguments); err != nil {
+		f.Arguments = map[string]any{}
+		f.ArgumentsError = fmt.Sprintf("invalid arguments %s: %v", args, err)
+	}
+	return nil
+}
 
-	r, err := http.NewRequest("POST", "http://localhost:11434/api/chat", bytes.NewBuffer(body))
-	if err != nil {
-		slog.Error("Request creation failed")
-		slog.Error(err.Error())
-		return LLMMessage{}, err
+// ToolResponse converts the call into the format the tools package executes.
+// The arguments are a copy, the call stays in the history as the model sent it
+func (c ToolCall) ToolResponse() *tools.ToolResponse {
+	args := maps.Clone(c.Function.Arguments)
+	if args == nil {
+		args = map[string]any{}
 	}
+	return &tools.ToolResponse{
+		Name:      c.Function.Name,
+		Arguments: args,
+	}
+}
+
+// list of LLM Messages
+type LLMMessages []LLMMessage
 
-	r.Header = map[string][]string{
-		"Content-Type": {"application/json"},
+// The completion interface should be provided as an abstraction to every model
+// This is useful to check
+type CompletionInterface interface {
+	Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error)
+	// Chat appends msgs (user or tool results) to the history and returns the reply
+	Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error)
+	// SetSystemPrompt replaces the system message that leads the history
+	SetSystemPrompt(p string)
+	// Capabilities the provider declares, see Register
+	Capabilities() Capabilities
+}
+
+// SetSystemPrompt keeps a single pinned system message at the start of the
+// history, an empty p removes it
+func (l *LLM) SetSystemPrompt(p string) {
+	if len(l.Messages) > 0 && l.Messages[0].Role == "system" {
+		l.Messages = l.Messages[1:]
+	}
+	if p == "" {
+		return
 	}
+	l.Messages = append([]LLMMessage{{Role: "system", Content: p, Pinned: true}}, l.Messages...)
+}
 
-	c := http.Client{}
-	res, err := c.Do(r)
-	if err != nil {
-		slog.Error("HTTP request failed")
-		slog.Error(err.Error())
+// Sender posts the whole conversation to a provider without touching any history
+type Sender interface {
+	Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error)
+}
+
+// chat keeps the history in l and lets s do the provider specific request
+func (l *LLM) chat(ctx context.Context, s Sender, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	if err := l.checkImages(msgs); err != nil {
 		return LLMMessage{}, err
 	}
-	defer res.Body.Close()
-	responsebody, err := io.ReadAll(res.Body)
+	l.Messages = append(l.Messages, msgs...)
+	l.trim(tool)
+	resp, err := s.Send(ctx, l.Messages, tool)
 	if err != nil {
-		slog.Error("ReadAll failed")
-		slog.Error(err.Error())
 		return LLMMessage{}, err
 	}
+	ensureToolCallIDs(&resp)
+	l.record(&resp)
+	l.Messages = append(l.Messages, resp)
+	return resp, nil
+}
 
-	var ollamaresponse OllamaResponse
-	err = json.Unmarshal(responsebody, &ollamaresponse)
-	if err != nil {
-		slog.Error("Unmarshal failed")
-		slog.Error(err.Error())
-		return LLMMessage{}, err
+// ollama does not always return ids, tool results still have to be linked to their call
+func ensureToolCallIDs(msg *LLMMessage) {
+	for i := range msg.ToolCalls {
+		if msg.ToolCalls[i].ID == "" {
+			msg.ToolCalls[i].ID = "call_" + uuid.NewString()
+		}
+		if msg.ToolCalls[i].Type == "" {
+			msg.ToolCalls[i].Type = "function"
+		}
 	}
+}
 
-	o.Messages = append(o.Messages, ollamaresponse.Message)
+func init() {
+	model := ConfigField{Name: "model", Description: "model name", Required: true}
+	apiKey := ConfigField{Name: "apiKey", Description: "api key", Required: true}
+	baseURL := ConfigField{Name: "baseURL", Description: "server url, empty uses the provider default"}
 
-	return ollamaresponse.Message, nil
+	Register("ollama", Provider{
+		New:          func(cfg Config) CompletionInterface { return &OllamaClient{LLM: cfg.LLM()} },
+		Capabilities: Capabilities{NativeTools: true, Streaming: true, Vision: true, JSONMode: true},
+		Schema:       []ConfigField{model, baseURL},
+		NewEmbedder:  newOllamaEmbedder,
+	})
+	Register("openai", Provider{
+		New:          newOpenAIClient(openAIBaseURL),
+		Capabilities: Capabilities{NativeTools: true, Streaming: true, Vision: true, JSONMode: true},
+		Schema:       []ConfigField{model, apiKey, baseURL},
+		NewEmbedder:  newOpenAIEmbedder(openAIBaseURL),
+	})
+	Register("openrouter", Provider{
+		New:          newOpenAIClient(openRouterBaseURL),
+		Capabilities: Capabilities{NativeTools: true, Streaming: true, Vision: true, JSONMode: true},
+		Schema:       []ConfigField{model, apiKey, baseURL},
+		NewEmbedder:  newOpenAIEmbedder(openRouterBaseURL),
+	})
+	// vLLM, llama.cpp server, LM Studio... speak the openai api on their own host
+	Register("openai-compatible", Provider{
+		New:          newOpenAIClient(openAICompatibleBaseURL),
+		Capabilities: Capabilities{NativeTools: true, Streaming: true, Vision: true, JSONMode: true},
+		Schema:       []ConfigField{model, {Name: "apiKey", Description: "api key, if the server wants one"}, baseURL},
+		NewEmbedder:  newOpenAIEmbedder(openAICompatibleBaseURL),
+	})
 }
 
-// Streaming version of Completion
-func (o *OllamaClient) CompletionStream(p string, tool []tools.Tool, onChunk func(content string, done bool, toolCall map[string]interface{})) error {
-	message := LLMMessage{
-		Role:    "user",
-		Content: p,
-	}
-	o.Messages = append(o.Messages, message)
+// Currently let's handle ollama and open router first
+type OllamaClient struct {
+	LLM
+}
+
+type OllamaRequest struct {
+	Model    string         `json:"model"`
+	Messages []LLMMessage   `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Tools    []tools.Tool   `json:"tools,omitempty"`
+	Format   any            `json:"format,omitempty"` // json schema of the reply
+	Think    *bool          `json:"think,omitempty"`  // reasoning models return their thinking apart from the content
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+type OllamaResponse struct {
+	Model   string     `json:"model"`
+	Create  string     `json:"created_at"`
+	Message LLMMessage `json:"message"`
+	Done    bool       `json:"done"`
+	Error   string     `json:"error,omitempty"` // only set mid stream
+
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// Completion sends p as a new user message
+func (o *OllamaClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return o.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
 
-	body, err := json.Marshal(OllamaRequest{
+func (o *OllamaClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return o.chat(ctx, o, msgs, tool)
+}
+
+// ollama completion logic the completion should be a tool call
+func (o *OllamaClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	req := OllamaRequest{
 		Model:    o.Model,
-		Messages: o.Messages,
-		Stream:   true,
+		Messages: msgs,
+		Stream:   false,
 		Tools:    tool,
-	})
-	if err != nil {
-		slog.Error("Marshal err")
-		slog.Error(err.Error())
-		return err
+		Think:    o.Options.Think,
+		Options:  o.Options.ollamaOptions(),
 	}
-
-	r, err := http.NewRequest("POST", "http://localhost:11434/api/chat", bytes.NewBuffer(body))
-	r.Header = map[string][]string{
-		"Content-Type": {"application/json"},
+	if o.structured(tool) {
+		req.Messages, req.Tools, req.Format = structuredMessages(msgs, tool), nil, ToolCallSchema(tool)
 	}
-
-	c := http.Client{}
-	res, err := c.Do(r)
-	if err != nil {
-		slog.Error(err.Error())
-		return err
+	var ollamaresponse OllamaResponse
+	if err := o.postJSON(ctx, o.url(ollamaBaseURL, "/api/chat"), nil, req, &ollamaresponse); err != nil {
+		return LLMMessage{}, err
 	}
-	defer res.Body.Close()
-
-	scanner := bufio.NewScanner(res.Body)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
-		}
-		var chunk map[string]interface{}
-		if err := json.Unmarshal(line, &chunk); err != nil {
-			continue
-		}
-		// Extract content and tool call
-		msg, ok := chunk["message"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-		content, _ := msg["content"].(string)
-		toolCall := msg["tool_calls"]
-		done, _ := chunk["done"].(bool)
-		onChunk(content, done, toolCall.(map[string]interface{}))
-		if done {
-			break
-		}
+	msg := ollamaresponse.Message
+	if o.structured(tool) {
+		parseStructured(&msg)
 	}
-	return nil
+	msg.Usage = newUsage(ollamaresponse.PromptEvalCount, ollamaresponse.EvalCount)
+	return msg, nil
 }
 
 // convert to Tool
@@ -180,129 +304,223 @@ type OpenAIClient struct {
 	LLM
 }
 
+// newOpenAIClient builds clients of the openai api hosted at defaultBase,
+// openrouter and the compatible servers only differ by their host
+func newOpenAIClient(defaultBase string) func(Config) CompletionInterface {
+	return func(cfg Config) CompletionInterface {
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = defaultBase
+		}
+		return &OpenAIClient{LLM: cfg.LLM()}
+	}
+}
+
 type OpenAIRequest struct {
-	Model    string       `json:"model"`
-	Messages []LLMMessage `json:"messages"`
-	Stream   bool         `json:"stream"`
-	Tools    []tools.Tool `json:"tools"`
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Stream         bool                  `json:"stream"`
+	StreamOptions  *openAIStreamOptions  `json:"stream_options,omitempty"`
+	Tools          []tools.Tool          `json:"tools,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	openAISampling
+}
+
+type openAIResponseFormat struct {
+	Type       string           `json:"type"` // "json_schema"
+	JSONSchema openAIJSONSchema `json:"json_schema"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+	Strict bool           `json:"strict"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type OpenAIResponse struct {
 	Choices []struct {
-		Message LLMMessage `json:"message"`
+		Message openAIReply `json:"message"`
 	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	Usage *openAIUsage `json:"usage"`
 }
 
-func (o *OpenAIClient) Completion(p string, tool []tools.Tool) (LLMMessage, error) {
-	message := LLMMessage{
-		Role:    "user",
-		Content: p,
-	}
-	o.Messages = append(o.Messages, message)
+// openAIReply is the message of a choice. Reasoning models send their thinking
+// as `reasoning` (openrouter) or `reasoning_content` (deepseek, vLLM)
+type openAIReply struct {
+	LLMMessage
+	Reasoning        string `json:"reasoning"`
+	ReasoningContent string `json:"reasoning_content"`
+}
 
-	body, err := json.Marshal(OpenAIRequest{
-		Model:    o.Model,
-		Messages: o.Messages,
-		Stream:   false,
-		Tools:    tool,
-	})
-	if err != nil {
-		slog.Error("Marshal err")
-		slog.Error(err.Error())
-		return LLMMessage{}, err
-	}
+func (r openAIReply) message() LLMMessage {
+	msg := r.LLMMessage
+	msg.Thinking = r.Reasoning + r.ReasoningContent
+	return msg
+}
 
-	r, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(body))
-	r.Header = map[string][]string{
-		"Content-Type": {"application/json"},
-		"Authorization": {"Bearer " + o.apiKey},
-	}
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
 
-	c := http.Client{}
-	res, err := c.Do(r)
-	if err != nil {
-		slog.Error(err.Error())
-		return LLMMessage{}, err
-	}
-	defer res.Body.Close()
-	responsebody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return LLMMessage{}, err
-	}
+// openai expects the tool call arguments as a json encoded string
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"` // a string, or parts when there are images
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
 
-	var openairesponse OpenAIResponse
-	err = json.Unmarshal(responsebody, &openairesponse)
-	if err != nil || len(openairesponse.Choices) == 0 {
-		return LLMMessage{}, err
-	}
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
 
-	msg := openairesponse.Choices[0].Message
-	o.Messages = append(o.Messages, msg)
-	return msg, nil
+type openAIImageURL struct {
+	URL string `json:"url"`
 }
 
-type OpenRouterClient struct {
-	LLM
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
-func (o *OpenRouterClient) Completion(p string, tool []tools.Tool) (LLMMessage, error) {
-	message := LLMMessage{
-		Role:    "user",
-		Content: p,
+func toOpenAIMessages(msgs []LLMMessage) []openAIMessage {
+	out := make([]openAIMessage, 0, len(msgs))
+	for _, m := range msgs {
+		om := openAIMessage{
+			Role:       m.Role,
+			Content:    m.Content,
+			ToolCallID: m.ToolCallID,
+		}
+		if len(m.Images) > 0 {
+			parts := []openAIContentPart{{Type: "text", Text: m.Content}}
+			for _, img := range m.Images {
+				parts = append(parts, openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: img.dataURI()}})
+			}
+			om.Content = parts
+		}
+		for _, call := range m.ToolCalls {
+			oc := openAIToolCall{ID: call.ID, Type: "function"}
+			oc.Function.Name = call.Function.Name
+			args, _ := json.Marshal(call.Function.Arguments)
+			oc.Function.Arguments = string(args)
+			om.ToolCalls = append(om.ToolCalls, oc)
+		}
+		out = append(out, om)
 	}
-	o.Messages = append(o.Messages, message)
+	return out
+}
 
-	body, err := json.Marshal(OpenAIRequest{
-		Model:    o.Model,
-		Messages: o.Messages,
-		Stream:   false,
-		Tools:    tool,
-	})
-	if err != nil {
-		slog.Error("Marshal err")
-		slog.Error(err.Error())
-		return LLMMessage{}, err
-	}
+func (o *OpenAIClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return o.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
 
-	r, err := http.NewRequest("POST", "https://openrouter.ai/api/v1/chat/completions", bytes.NewBuffer(body))
-	r.Header = map[string][]string{
-		"Content-Type": {"application/json"},
-		"Authorization": {"Bearer " + o.apiKey},
-	}
+func (o *OpenAIClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return o.chat(ctx, o, msgs, tool)
+}
 
-	c := http.Client{}
-	res, err := c.Do(r)
-	if err != nil {
-		slog.Error(err.Error())
-		return LLMMessage{}, err
+func (o *OpenAIClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return o.openAISend(ctx, o.url(openAIBaseURL, "/chat/completions"), msgs, tool)
+}
+
+// openAISend posts a chat completion to an openai compatible endpoint
+func (l *LLM) openAISend(ctx context.Context, endpoint string, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	req := OpenAIRequest{
+		Model:          l.Model,
+		Messages:       toOpenAIMessages(msgs),
+		Stream:         false,
+		Tools:          tool,
+		openAISampling: l.Options.openAI(),
 	}
-	defer res.Body.Close()
-	responsebody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return LLMMessage{}, err
+	if l.structured(tool) {
+		req.Messages, req.Tools = toOpenAIMessages(structuredMessages(msgs, tool)), nil
+		// not strict, strict schemas must require every property
+		req.ResponseFormat = &openAIResponseFormat{Type: "json_schema", JSONSchema: openAIJSONSchema{Name: "tool_call", Schema: ToolCallSchema(tool)}}
 	}
-
 	var openairesponse OpenAIResponse
-	err = json.Unmarshal(responsebody, &openairesponse)
-	if err != nil || len(openairesponse.Choices) == 0 {
+	if err := l.postJSON(ctx, endpoint, l.bearer(), req, &openairesponse); err != nil {
 		return LLMMessage{}, err
 	}
+	// some compatible servers answer 200 with an error body or no choices at all
+	if len(openairesponse.Choices) == 0 {
+		msg := "no choices returned"
+		if openairesponse.Error != nil {
+			msg = openairesponse.Error.Message
+		}
+		return LLMMessage{}, &APIError{Provider: l.providerName(endpoint), Kind: ErrUnknown, Message: msg}
+	}
 
-	msg := openairesponse.Choices[0].Message
-	o.Messages = append(o.Messages, msg)
+	msg := openairesponse.Choices[0].Message.message()
+	if l.structured(tool) {
+		parseStructured(&msg)
+	}
+	if openairesponse.Usage != nil {
+		msg.Usage = newUsage(openairesponse.Usage.PromptTokens, openairesponse.Usage.CompletionTokens)
+	}
 	return msg, nil
 }
 
-// Factory for LLM
-func NewLLMFromConfig(model, apiKey, provider string) CompletionInterface {
-	switch provider {
-	case "openai":
-		return &OpenAIClient{LLM: LLM{Model: model, apiKey: apiKey, provider: provider}}
-	case "openrouter":
-		return &OpenRouterClient{LLM: LLM{Model: model, apiKey: apiKey, provider: provider}}
-	case "ollama":
-		fallthrough
-	default:
-		return &OllamaClient{LLM: LLM{Model: model, apiKey: apiKey, provider: provider}}
+func (l *LLM) bearer() map[string]string {
+	if l.apiKey == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + l.apiKey}
+}
+
+// Config is what NewLLMFromConfig needs to build a client
+type Config struct {
+	Provider string
+	Model    string
+	APIKey   string
+	BaseURL  string // e.g. a shared ollama box or a vLLM / llama.cpp / LM Studio server
+	Prices   PriceTable
+	Context  ContextPolicy // budget of the model, see TrimMessages
+	Retry    RetryPolicy   // zero value uses DefaultRetryPolicy
+
+	Cassette string // replay provider: file of recorded requests
+	Record   string // replay provider: provider that answers requests missing from the cassette
+
+	Fallback []Config          // tried in order when the provider fails, see Router
+	Routes   map[string]Config // backend for a task, e.g. a cheap model for TaskThinking
+	Cache    CacheConfig       // replies are cached on disk when Cache.Dir is set
+
+	Structured bool    // json schema tool calls instead of native ones, ollama and openai compatible only
+	Options    Options // sampling parameters
+}
+
+// NewLLMFromConfig builds the client of the registered provider, wrapped in a
+// cache and a Router when cfg asks for them. An unknown provider is ollama
+func NewLLMFromConfig(cfg Config) CompletionInterface {
+	if caps := cfg.capabilities(); !caps.NativeTools && caps.JSONMode {
+		// the schema gets tool calls out of models that cannot call them natively
+		cfg.Structured = true
+	}
+	if cfg.Cache.Dir != "" {
+		inner := cfg
+		inner.Cache = CacheConfig{}
+		if sender, ok := NewLLMFromConfig(inner).(Sender); ok {
+			return &CachingClient{LLM: cfg.LLM(), Inner: sender, Cache: NewResponseCache(cfg.Cache)}
+		}
+	}
+	if len(cfg.Fallback) > 0 || len(cfg.Routes) > 0 {
+		return newRouter(cfg)
+	}
+	p, ok := LookupProvider(cfg.provider())
+	if !ok {
+		log.LogEvent("unknown_provider", cfg.Provider)
+		p, _ = LookupProvider("ollama")
 	}
+	return p.New(cfg)
 }
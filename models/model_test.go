@@ -1,12 +1,26 @@
 package models_test
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"spysearch/models"
 	"spysearch/tools"
+	"strings"
 	"testing"
 )
 
+// replay answers from a cassette in testdata, no model has to run
+func replay(cassette string) models.CompletionInterface {
+	return models.NewLLMFromConfig(models.Config{
+		Provider: "replay",
+		Model:    "qwen2.5-coder:3b",
+		Cassette: filepath.Join("testdata", cassette),
+	})
+}
+
 func TestOllamaCompletion(t *testing.T) {
 	mock_properties := map[string]tools.ToolProperty{}
 
@@ -32,38 +46,178 @@ func TestOllamaCompletion(t *testing.T) {
 
 	list_tool := append([]tools.Tool{}, mock_tool)
 
-	m := models.OllamaClient{}
-	m.Completion("What is the weather today in Toronto? You are require to use tool", list_tool)
-	m.Completion("what did i ask ?", list_tool)
-	fmt.Println(m.Messages)
+	m := replay("weather.json")
+	r, err := m.Completion(context.Background(), "What is the weather today in Toronto? You are require to use tool", list_tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ToolCalls) != 1 || r.ToolCalls[0].Function.Name != "get_current_weather" {
+		t.Fatalf("expected a get_current_weather call, got %+v", r)
+	}
+
+	// the second request carries the first turn, otherwise it would not match the cassette
+	r, err = m.Completion(context.Background(), "what did i ask ?", list_tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(r.Content, "Toronto") {
+		t.Errorf("unexpected answer %q", r.Content)
+	}
 }
 
 func TestThinkingTool(t *testing.T) {
 	tk := tools.NewThinkingTool()
 
 	list_tool := append([]tools.Tool{}, tk.Tool)
-	(&models.OllamaClient{}).Completion("Why my merge sort not working", list_tool)
+	r, err := replay("thinking.json").Completion(context.Background(), "Why my merge sort not working", list_tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ToolCalls) != 1 {
+		t.Fatalf("expected a thinking call, got %+v", r)
+	}
 
+	result, err := tk.Execute(context.Background(), r.ToolCalls[0].Function.Arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Result, "merge step") {
+		t.Errorf("unexpected thinking result %q", result.Result)
+	}
 }
 
 func TestBashTool(t *testing.T) {
 	tk := tools.NewBashTool()
 	list_tool := append([]tools.Tool{}, tk.Tool)
-	r, err := (&models.OllamaClient{}).Completion("Create a new file name test.txt", list_tool)
+	r, err := replay("bash.json").Completion(context.Background(), "Create a new file name test.txt", list_tool)
 	if err != nil {
-		fmt.Println(err)
-		return
+		t.Fatal(err)
 	}
 
+	// the model answers with a fenced json block instead of a native call
 	toolResponse, err := tools.ExtractResponse(r.Content)
 	if err != nil {
-		fmt.Println(err)
-		return
+		t.Fatal(err)
+	}
+	if toolResponse.Name != "bash" || toolResponse.Arguments["command"] != "touch test.txt" {
+		t.Errorf("unexpected tool call %+v", toolResponse)
+	}
+}
+
+func TestToolCallArguments(t *testing.T) {
+	// ollama sends the arguments as an object
+	var ollama models.LLMMessage
+	err := json.Unmarshal([]byte(`{"role":"assistant","content":"","tool_calls":[{"function":{"name":"bash","arguments":{"command":"ls"}}}]}`), &ollama)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for i := range list_tool {
-		if list_tool[i].ToolFunction.Name == toolResponse.Name {
-			list_tool[i].Execute(toolResponse.Arguments)
+	// openai sends the arguments as a json encoded string
+	var openai models.LLMMessage
+	err = json.Unmarshal([]byte(`{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"bash","arguments":"{\"command\":\"ls\"}"}}]}`), &openai)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []models.LLMMessage{ollama, openai} {
+		if len(msg.ToolCalls) != 1 {
+			t.Fatalf("expected 1 tool call, got %d", len(msg.ToolCalls))
+		}
+		call := msg.ToolCalls[0].ToolResponse()
+		if call.Name != "bash" || call.Arguments["command"] != "ls" {
+			t.Errorf("unexpected tool call %+v", call)
 		}
+		// what a tool adds to its arguments stays out of the history
+		call.Arguments["workDir"] = "/tmp"
+		if _, ok := msg.ToolCalls[0].Function.Arguments["workDir"]; ok {
+			t.Error("ToolResponse shares the arguments of the call")
+		}
+	}
+	if openai.ToolCalls[0].ID != "call_1" {
+		t.Errorf("expected id call_1, got %q", openai.ToolCalls[0].ID)
+	}
+
+	// malformed arguments keep the call and the rest of the reply
+	var malformed models.LLMMessage
+	err = json.Unmarshal([]byte(`{"role":"assistant","content":"ok","tool_calls":[{"id":"call_2","type":"function","function":{"name":"bash","arguments":"{\"command\": "}}]}`), &malformed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(malformed.ToolCalls) != 1 || malformed.ToolCalls[0].Function.ArgumentsError == "" || malformed.Content != "ok" {
+		t.Errorf("expected the call with an arguments error, got %+v", malformed)
+	}
+}
+
+func TestToolResultMessages(t *testing.T) {
+	cases := []struct {
+		provider string
+		reply    string // the first reply asks for a bash call
+		answer   string
+	}{
+		// ollama leaves the id out, the client has to make one up
+		{"ollama", `{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"bash","arguments":{"command":"ls"}}}]},"done":true}`,
+			`{"message":{"role":"assistant","content":"two files"},"done":true}`},
+		{"openai-compatible", `{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"bash","arguments":"{\"command\":\"ls\"}"}}]}}]}`,
+			`{"choices":[{"message":{"role":"assistant","content":"two files"}}]}`},
+	}
+	for _, c := range cases {
+		t.Run(c.provider, func(t *testing.T) {
+			var requests []map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req map[string]any
+				json.NewDecoder(r.Body).Decode(&req)
+				requests = append(requests, req)
+				if len(requests) == 1 {
+					w.Write([]byte(c.reply))
+					return
+				}
+				w.Write([]byte(c.answer))
+			}))
+			defer server.Close()
+
+			client := models.NewLLMFromConfig(models.Config{Provider: c.provider, Model: "local", BaseURL: server.URL})
+			bash := []tools.Tool{tools.NewBashTool().Tool}
+			call, err := client.Completion(context.Background(), "list files", bash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(call.ToolCalls) != 1 || call.ToolCalls[0].ID == "" || call.ToolCalls[0].Type != "function" {
+				t.Fatalf("expected a bash call with an id, got %+v", call)
+			}
+			id := call.ToolCalls[0].ID
+
+			answer, err := client.Chat(context.Background(), []models.LLMMessage{models.ToolMessage(call.ToolCalls[0], "a.txt b.txt")}, bash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer.Content != "two files" {
+				t.Errorf("unexpected answer %+v", answer)
+			}
+
+			msgs := requests[1]["messages"].([]any)
+			if len(msgs) != 3 {
+				t.Fatalf("expected the task, the call and its result, got %v", msgs)
+			}
+			sent := msgs[1].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)
+			if sent["id"] != id {
+				t.Errorf("expected the call to keep id %q, got %v", id, sent)
+			}
+			args := sent["function"].(map[string]any)["arguments"]
+			if c.provider == "ollama" {
+				if args.(map[string]any)["command"] != "ls" {
+					t.Errorf("ollama expects the arguments as an object, got %v", args)
+				}
+			} else if args != `{"command":"ls"}` {
+				t.Errorf("openai expects the arguments as a json string, got %v", args)
+			}
+
+			result := msgs[2].(map[string]any)
+			if result["role"] != "tool" || result["tool_call_id"] != id || result["content"] != "a.txt b.txt" {
+				t.Errorf("expected a tool message linked to %q, got %v", id, result)
+			}
+			if c.provider == "ollama" && result["tool_name"] != "bash" {
+				t.Errorf("ollama links results by tool name, got %v", result)
+			}
+		})
 	}
 }
@@ -0,0 +1,95 @@
+package models
+
+// Options are the sampling parameters sent with every request, unset fields
+// leave the provider default. Providers without an equivalent ignore a field,
+// e.g. anthropic has no seed
+type Options struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"topP,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+
+	NumCtx int            `json:"numCtx,omitempty"` // ollama context window, its default is small
+	Think  *bool          `json:"think,omitempty"`  // ollama reasoning models, false skips the thinking
+	Ollama map[string]any `json:"ollama,omitempty"` // any other ollama option, e.g. repeat_penalty
+}
+
+// Merge returns o with the fields set in over replaced, used for per model overrides
+func (o Options) Merge(over Options) Options {
+	if over.Temperature != nil {
+		o.Temperature = over.Temperature
+	}
+	if over.TopP != nil {
+		o.TopP = over.TopP
+	}
+	if over.Seed != nil {
+		o.Seed = over.Seed
+	}
+	if over.MaxTokens != 0 {
+		o.MaxTokens = over.MaxTokens
+	}
+	if over.Stop != nil {
+		o.Stop = over.Stop
+	}
+	if over.NumCtx != 0 {
+		o.NumCtx = over.NumCtx
+	}
+	if over.Think != nil {
+		o.Think = over.Think
+	}
+	if len(over.Ollama) > 0 {
+		merged := map[string]any{}
+		for k, v := range o.Ollama {
+			merged[k] = v
+		}
+		for k, v := range over.Ollama {
+			merged[k] = v
+		}
+		o.Ollama = merged
+	}
+	return o
+}
+
+// ollamaOptions is the `options` object of an ollama request
+func (o Options) ollamaOptions() map[string]any {
+	opts := map[string]any{}
+	for k, v := range o.Ollama {
+		opts[k] = v
+	}
+	if o.Temperature != nil {
+		opts["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		opts["top_p"] = *o.TopP
+	}
+	if o.Seed != nil {
+		opts["seed"] = *o.Seed
+	}
+	if o.MaxTokens != 0 {
+		opts["num_predict"] = o.MaxTokens
+	}
+	if len(o.Stop) > 0 {
+		opts["stop"] = o.Stop
+	}
+	if o.NumCtx != 0 {
+		opts["num_ctx"] = o.NumCtx
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+// openAISampling is embedded in OpenAIRequest
+type openAISampling struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+func (o Options) openAI() openAISampling {
+	return openAISampling{Temperature: o.Temperature, TopP: o.TopP, Seed: o.Seed, MaxTokens: o.MaxTokens, Stop: o.Stop}
+}
@@ -0,0 +1,56 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"testing"
+)
+
+func TestOptionsPerProvider(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if r.URL.Path == "/api/chat" {
+			w.Write([]byte(`{"message":{"role":"assistant","content":"ok"},"done":true}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	zero, seed := 0.0, 42
+	opts := models.Options{Temperature: &zero, Seed: &seed, MaxTokens: 256, Stop: []string{"```"}, NumCtx: 16384, Ollama: map[string]any{"repeat_penalty": 1.1}}
+
+	ollama := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen2.5-coder:7b", BaseURL: server.URL, Options: opts})
+	if _, err := ollama.Completion(context.Background(), "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	o := got["options"].(map[string]any)
+	// a temperature of 0 is a setting, not a missing value
+	if o["temperature"] != 0.0 || o["seed"] != 42.0 || o["num_predict"] != 256.0 || o["num_ctx"] != 16384.0 || o["repeat_penalty"] != 1.1 {
+		t.Errorf("unexpected ollama options %v", o)
+	}
+
+	openai := models.NewLLMFromConfig(models.Config{Provider: "openai-compatible", Model: "local", BaseURL: server.URL, Options: opts})
+	if _, err := openai.Completion(context.Background(), "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got["temperature"] != 0.0 || got["seed"] != 42.0 || got["max_tokens"] != 256.0 || got["num_ctx"] != nil || got["top_p"] != nil {
+		t.Errorf("unexpected openai request %v", got)
+	}
+}
+
+func TestOptionsMerge(t *testing.T) {
+	global, local := 0.2, 0.8
+	seed := 7
+	merged := models.Options{Temperature: &global, Seed: &seed, NumCtx: 4096}.Merge(models.Options{Temperature: &local, NumCtx: 32768})
+	if *merged.Temperature != 0.8 || *merged.Seed != 7 || merged.NumCtx != 32768 {
+		t.Errorf("unexpected merge %+v", merged)
+	}
+	if models.CacheKey(models.CacheBackend{Provider: "ollama", Model: "m", Options: merged}, nil, nil) == models.CacheKey(models.CacheBackend{Provider: "ollama", Model: "m"}, nil, nil) {
+		t.Error("options should change the cache key")
+	}
+}
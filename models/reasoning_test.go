@@ -0,0 +1,97 @@
+package models_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"strings"
+	"testing"
+)
+
+func TestOllamaThinking(t *testing.T) {
+	think := false
+	var body map[string]any
+	server := capture(`{"message":{"role":"assistant","thinking":"2 and 2","content":"4"},"done":true}`, &body)
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen3", BaseURL: server.URL, Options: models.Options{Think: &think}})
+	resp, err := client.Completion(context.Background(), "2+2?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Thinking != "2 and 2" || resp.Content != "4" {
+		t.Errorf("unexpected reply %+v", resp)
+	}
+	if body["think"] != false {
+		t.Errorf("expected think in the request, got %v", body)
+	}
+}
+
+func TestOllamaStreamThinking(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","thinking":"2 and ","content":""},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","thinking":"2","content":""},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"4"},"done":true}`)
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen3", BaseURL: server.URL})
+	var thought strings.Builder
+	resp, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "2+2?", nil, func(chunk models.StreamChunk) {
+		thought.WriteString(chunk.Thinking)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thought.String() != "2 and 2" || resp.Thinking != "2 and 2" || resp.Content != "4" {
+		t.Errorf("unexpected reply %+v, streamed thinking %q", resp, thought.String())
+	}
+}
+
+func TestOpenRouterReasoning(t *testing.T) {
+	var body map[string]any
+	server := capture(`{"choices":[{"message":{"role":"assistant","content":"4","reasoning":"2 and 2"}}]}`, &body)
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openrouter", Model: "deepseek/deepseek-r1", APIKey: "key", BaseURL: server.URL})
+	resp, err := client.Completion(context.Background(), "2+2?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Thinking != "2 and 2" || resp.Content != "4" {
+		t.Errorf("unexpected reply %+v", resp)
+	}
+
+	// the reasoning stays out of the next request
+	client.Completion(context.Background(), "and 3+3?", nil)
+	if strings.Contains(fmt.Sprint(body["messages"]), "2 and 2") {
+		t.Errorf("reasoning was sent back: %v", body["messages"])
+	}
+}
+
+func TestOpenAIStreamReasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range []string{
+			`{"choices":[{"delta":{"role":"assistant","reasoning_content":"2 and 2"}}]}`,
+			`{"choices":[{"delta":{"content":"4"}}]}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openai-compatible", Model: "local", BaseURL: server.URL + "/v1"})
+	chunks := []models.StreamChunk{}
+	resp, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "2+2?", nil, func(chunk models.StreamChunk) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Thinking != "2 and 2" || resp.Content != "4" || chunks[0].Thinking != "2 and 2" {
+		t.Errorf("unexpected reply %+v, chunks %+v", resp, chunks)
+	}
+}
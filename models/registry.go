@@ -0,0 +1,151 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"spysearch/tools"
+	"sync"
+)
+
+// Capabilities are what a provider declares it supports, the agent adapts to them,
+// e.g. tools are described in the prompt when there is no native tool calling
+type Capabilities struct {
+	NativeTools bool // tool calls come back as ToolCalls
+	Streaming   bool // the client implements StreamingCompletion
+	Vision      bool // user messages can carry images
+	JSONMode    bool // replies can be constrained to a json schema, see Config.Structured
+}
+
+// ConfigField documents a setting a provider reads, Name is its key in config.json
+type ConfigField struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Provider is a backend NewLLMFromConfig can build. New gets the whole config
+// and usually embeds cfg.LLM() in the client it returns
+type Provider struct {
+	New          func(cfg Config) CompletionInterface
+	Capabilities Capabilities
+	Schema       []ConfigField
+	// NewEmbedder is what NewEmbedderFromConfig sends batches with, nil when the provider has no embeddings api
+	NewEmbedder func(cfg Config) EmbedSender
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{}
+)
+
+// Register makes a provider available under name, usually from an init function.
+// Registering the same name twice or a provider without New panics
+func Register(name string, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if p.New == nil {
+		panic("models: Register provider " + name + " without New")
+	}
+	if _, dup := providers[name]; dup {
+		panic("models: Register called twice for provider " + name)
+	}
+	providers[name] = p
+}
+
+// LookupProvider returns the provider registered under name
+func LookupProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// Providers are the registered provider names, sorted
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Missing lists the required fields cfg leaves empty
+func (p Provider) Missing(cfg Config) []string {
+	values := map[string]string{
+		"model":    cfg.Model,
+		"apiKey":   cfg.APIKey,
+		"baseURL":  cfg.BaseURL,
+		"cassette": cfg.Cassette,
+		"record":   cfg.Record,
+	}
+	missing := []string{}
+	for _, f := range p.Schema {
+		if f.Required && values[f.Name] == "" {
+			missing = append(missing, f.Name)
+		}
+	}
+	return missing
+}
+
+// LLM is the base every client embeds: model, key, endpoint, prices and
+// capabilities of cfg with an empty history
+func (cfg Config) LLM() LLM {
+	return LLM{
+		Model:      cfg.Model,
+		apiKey:     cfg.APIKey,
+		provider:   cfg.Provider,
+		BaseURL:    cfg.BaseURL,
+		Prices:     cfg.Prices,
+		Context:    cfg.Context,
+		Retry:      cfg.Retry,
+		Structured: cfg.Structured,
+		Options:    cfg.Options,
+		caps:       cfg.capabilities(),
+	}
+}
+
+// capabilities of the provider of cfg, a fallback chain only has what every backend has
+func (cfg Config) capabilities() Capabilities {
+	p, _ := LookupProvider(cfg.provider())
+	caps := p.Capabilities
+	for _, c := range cfg.Fallback {
+		other := c.capabilities()
+		caps.NativeTools = caps.NativeTools && other.NativeTools
+		caps.Streaming = caps.Streaming && other.Streaming
+		caps.Vision = caps.Vision && other.Vision
+		caps.JSONMode = caps.JSONMode && other.JSONMode
+	}
+	return caps
+}
+
+// provider defaults to ollama like the first version did
+func (cfg Config) provider() string {
+	if cfg.Provider == "" {
+		return "ollama"
+	}
+	return cfg.Provider
+}
+
+// APIKey of the client, for providers registered outside this package
+func (l *LLM) APIKey() string {
+	return l.apiKey
+}
+
+// Capabilities of the provider. Structured output turns json replies into
+// ToolCalls, so a client using it has native tools as far as the agent can tell
+func (l *LLM) Capabilities() Capabilities {
+	caps := l.caps
+	if l.Structured {
+		caps.NativeTools = true
+	}
+	return caps
+}
+
+// ChatWith is chat for clients registered outside this package: msgs are added to
+// the history, the history is trimmed and sent with s and the reply recorded
+func (l *LLM) ChatWith(ctx context.Context, s Sender, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return l.chat(ctx, s, msgs, tool)
+}
@@ -0,0 +1,87 @@
+package models_test
+
+import (
+	"context"
+	"slices"
+	"spysearch/models"
+	"spysearch/tools"
+	"testing"
+)
+
+// echoClient is a backend registered from outside the package
+type echoClient struct {
+	models.LLM
+}
+
+func (e *echoClient) Completion(ctx context.Context, p string, tool []tools.Tool) (models.LLMMessage, error) {
+	return e.Chat(ctx, []models.LLMMessage{models.UserMessage(p)}, tool)
+}
+
+func (e *echoClient) Chat(ctx context.Context, msgs []models.LLMMessage, tool []tools.Tool) (models.LLMMessage, error) {
+	return e.ChatWith(ctx, e, msgs, tool)
+}
+
+func (e *echoClient) Send(ctx context.Context, msgs []models.LLMMessage, tool []tools.Tool) (models.LLMMessage, error) {
+	return models.AssistantMessage(e.Model + ": " + msgs[len(msgs)-1].Content), nil
+}
+
+func init() {
+	models.Register("echo", models.Provider{
+		New:          func(cfg models.Config) models.CompletionInterface { return &echoClient{LLM: cfg.LLM()} },
+		Capabilities: models.Capabilities{JSONMode: true},
+		Schema:       []models.ConfigField{{Name: "model", Required: true}},
+	})
+}
+
+func TestRegisteredProvider(t *testing.T) {
+	if !slices.Contains(models.Providers(), "echo") {
+		t.Fatalf("echo is not listed in %v", models.Providers())
+	}
+	client := models.NewLLMFromConfig(models.Config{Provider: "echo", Model: "parrot"})
+	resp, err := client.Completion(context.Background(), "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "parrot: hello" {
+		t.Errorf("unexpected reply %q", resp.Content)
+	}
+	// json mode without native tools switches to structured output
+	if !client.(*echoClient).Structured || !client.Capabilities().NativeTools {
+		t.Errorf("expected structured output, got %+v", client.Capabilities())
+	}
+
+	p, _ := models.LookupProvider("echo")
+	if missing := p.Missing(models.Config{Provider: "echo"}); !slices.Equal(missing, []string{"model"}) {
+		t.Errorf("expected model to be missing, got %v", missing)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	models.Register("ollama", models.Provider{New: func(cfg models.Config) models.CompletionInterface { return nil }})
+}
+
+func TestOpenRouterUsesOpenAIClient(t *testing.T) {
+	client, ok := models.NewLLMFromConfig(models.Config{Provider: "openrouter", Model: "m"}).(*models.OpenAIClient)
+	if !ok {
+		t.Fatal("expected an OpenAIClient")
+	}
+	if client.BaseURL != "https://openrouter.ai/api/v1" {
+		t.Errorf("unexpected base url %q", client.BaseURL)
+	}
+}
+
+func TestFallbackCapabilities(t *testing.T) {
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai", Model: "gpt-4o",
+		Fallback: []models.Config{{Provider: "anthropic", Model: "claude"}},
+	})
+	caps := client.Capabilities()
+	if !caps.NativeTools || caps.Streaming {
+		t.Errorf("a chain should only have what every backend has, got %+v", caps)
+	}
+}
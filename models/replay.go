@@ -0,0 +1,236 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"spysearch/tools"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecorded is returned by a ReplayClient without recorder for a request
+// that is not in its cassette
+var ErrNotRecorded = errors.New("replay: request not found in cassette")
+
+// Cassette is a file of recorded request/response pairs
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  ReplayRequest `json:"request"`
+	Response LLMMessage    `json:"response"`
+	Usage    *Usage        `json:"usage,omitempty"`
+}
+
+// ReplayRequest is the normalized form of a request, two requests match when
+// their normalized forms are equal. Tool call ids are generated per run and
+// whitespace differs between models, so both are left out
+type ReplayRequest struct {
+	Model    string          `json:"model"`
+	Messages []replayMessage `json:"messages"`
+	Tools    []string        `json:"tools,omitempty"`
+}
+
+type replayMessage struct {
+	Role      string             `json:"role"`
+	Content   string             `json:"content"`
+	ToolCalls []ToolCallFunction `json:"tool_calls,omitempty"`
+}
+
+func NormalizeRequest(model string, msgs []LLMMessage, tool []tools.Tool) ReplayRequest {
+	req := ReplayRequest{Model: model, Messages: []replayMessage{}}
+	for _, m := range msgs {
+		rm := replayMessage{Role: m.Role, Content: strings.Join(strings.Fields(m.Content), " ")}
+		for _, c := range m.ToolCalls {
+			rm.ToolCalls = append(rm.ToolCalls, c.Function)
+		}
+		req.Messages = append(req.Messages, rm)
+	}
+	for _, t := range tool {
+		req.Tools = append(req.Tools, t.ToolFunction.Name)
+	}
+	sort.Strings(req.Tools)
+	return req
+}
+
+// key is used to compare normalized requests, maps are marshaled with sorted keys
+func (r ReplayRequest) key() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+func init() {
+	Register("replay", Provider{
+		New:          newReplayProvider,
+		Capabilities: Capabilities{NativeTools: true},
+		Schema: []ConfigField{
+			{Name: "cassette", Description: "file of recorded requests", Required: true},
+			{Name: "record", Description: "provider that answers requests missing from the cassette"},
+		},
+	})
+}
+
+func newReplayProvider(cfg Config) CompletionInterface {
+	var recorder Sender
+	if cfg.Record != "" && cfg.Record != "replay" {
+		inner := cfg
+		inner.Provider = cfg.Record
+		recorder, _ = NewLLMFromConfig(inner).(Sender)
+	}
+	r := NewReplayClient(cfg.Cassette, recorder)
+	r.LLM = cfg.LLM()
+	return r
+}
+
+// ReplayClient answers from a cassette file. With a recorder, requests that are
+// not in the cassette are sent to it and the answer is saved, so a test can be
+// recorded once against a real model and replayed offline afterwards
+type ReplayClient struct {
+	LLM
+	Path     string
+	Recorder Sender // nil replays only
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+	loadErr  error
+}
+
+func NewReplayClient(path string, recorder Sender) *ReplayClient {
+	r := &ReplayClient{Path: path, Recorder: recorder}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			r.loadErr = err
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.cassette); err != nil {
+		r.loadErr = fmt.Errorf("replay: cassette %s: %w", path, err)
+	}
+	r.used = make([]bool, len(r.cassette.Interactions))
+	return r
+}
+
+// Completion sends p as a new user message
+func (r *ReplayClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return r.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (r *ReplayClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return r.chat(ctx, r, msgs, tool)
+}
+
+// Send replays the first unused interaction matching the request, identical
+// requests sent more often than recorded get the last matching answer again
+func (r *ReplayClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	if r.loadErr != nil {
+		return LLMMessage{}, r.loadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return LLMMessage{}, err
+	}
+	req := NormalizeRequest(r.Model, msgs, tool)
+	key := req.key()
+
+	r.mu.Lock()
+	match := -1
+	for i, in := range r.cassette.Interactions {
+		if in.Request.key() != key {
+			continue
+		}
+		match = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if match >= 0 {
+		r.used[match] = true
+		in := r.cassette.Interactions[match]
+		r.mu.Unlock()
+		resp := in.Response
+		resp.ToolCalls = append([]ToolCall(nil), resp.ToolCalls...)
+		resp.Usage = in.Usage
+		return resp, nil
+	}
+	r.mu.Unlock()
+
+	if r.Recorder == nil {
+		return LLMMessage{}, fmt.Errorf("%w: %s (%d messages)", ErrNotRecorded, r.Path, len(msgs))
+	}
+	resp, err := r.Recorder.Send(ctx, msgs, tool)
+	if err != nil {
+		return resp, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{Request: req, Response: resp, Usage: resp.Usage})
+	r.used = append(r.used, true)
+	return resp, r.save()
+}
+
+func (r *ReplayClient) save() error {
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(r.Path); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	return os.WriteFile(r.Path, data, 0644)
+}
+
+// ScriptedClient is a fake model for tests, it answers with Replies in order
+// and keeps every request it was sent
+type ScriptedClient struct {
+	LLM
+	Replies  []LLMMessage
+	Requests [][]LLMMessage
+}
+
+func NewScriptedClient(replies ...LLMMessage) *ScriptedClient {
+	return &ScriptedClient{LLM: LLM{caps: Capabilities{NativeTools: true}}, Replies: replies}
+}
+
+// AssistantMessage is a plain text reply
+func AssistantMessage(content string) LLMMessage {
+	return LLMMessage{Role: "assistant", Content: content}
+}
+
+// ToolCallMessage is a reply calling the tool name with args
+func ToolCallMessage(name string, args map[string]any) LLMMessage {
+	return LLMMessage{
+		Role:      "assistant",
+		ToolCalls: []ToolCall{{Type: "function", Function: ToolCallFunction{Name: name, Arguments: args}}},
+	}
+}
+
+// Completion sends p as a new user message
+func (s *ScriptedClient) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return s.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (s *ScriptedClient) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return s.chat(ctx, s, msgs, tool)
+}
+
+func (s *ScriptedClient) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return LLMMessage{}, err
+	}
+	s.Requests = append(s.Requests, append([]LLMMessage{}, msgs...))
+	n := len(s.Requests)
+	if n > len(s.Replies) {
+		return LLMMessage{}, fmt.Errorf("scripted: no reply left for request %d", n)
+	}
+	resp := s.Replies[n-1]
+	resp.ToolCalls = append([]ToolCall(nil), resp.ToolCalls...)
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"spysearch/models"
+	"spysearch/tools"
+	"testing"
+)
+
+func TestReplayRecordsThenReplays(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"done","arguments":{"message":"ok"}}}]},"done":true,"prompt_eval_count":10,"eval_count":5}`))
+	}))
+	defer server.Close()
+
+	cassette := filepath.Join(t.TempDir(), "done.json")
+	cfg := models.Config{Provider: "replay", Record: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL, Cassette: cassette}
+	toolList := []tools.Tool{tools.NewDoneTool().Tool}
+
+	recorded, err := models.NewLLMFromConfig(cfg).Completion(context.Background(), "finish", toolList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replay only, the server must not be asked again
+	cfg.Record = ""
+	replayed, err := models.NewLLMFromConfig(cfg).Completion(context.Background(), "  finish\n", toolList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("expected a single request to the server, got %d", calls)
+	}
+	if len(replayed.ToolCalls) != 1 || replayed.ToolCalls[0].Function.Name != recorded.ToolCalls[0].Function.Name {
+		t.Errorf("replayed %+v, recorded %+v", replayed, recorded)
+	}
+	if replayed.Usage == nil || replayed.Usage.TotalTokens != 15 {
+		t.Errorf("expected the recorded usage, got %+v", replayed.Usage)
+	}
+
+	_, err = models.NewLLMFromConfig(cfg).Completion(context.Background(), "something else", toolList)
+	if !errors.Is(err, models.ErrNotRecorded) {
+		t.Errorf("expected ErrNotRecorded, got %v", err)
+	}
+}
+
+func TestScriptedClient(t *testing.T) {
+	client := models.NewScriptedClient(
+		models.ToolCallMessage("bash", map[string]any{"command": "ls"}),
+		models.AssistantMessage("there are two files"),
+	)
+	first, err := client.Completion(context.Background(), "list files", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.ToolCalls) != 1 || first.ToolCalls[0].ID == "" {
+		t.Fatalf("expected a tool call with an id, got %+v", first)
+	}
+	second, err := client.Chat(context.Background(), []models.LLMMessage{models.ToolMessage(first.ToolCalls[0], "a.go b.go")}, nil)
+	if err != nil || second.Content != "there are two files" {
+		t.Fatalf("unexpected reply %+v, %v", second, err)
+	}
+	// the second request carries the whole history
+	if len(client.Requests) != 2 || len(client.Requests[1]) != 3 {
+		t.Errorf("unexpected requests %+v", client.Requests)
+	}
+	if _, err := client.Completion(context.Background(), "more", nil); err == nil {
+		t.Error("expected an error once the script is exhausted")
+	}
+}
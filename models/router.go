@@ -0,0 +1,188 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"spysearch/log"
+	"spysearch/tools"
+)
+
+// tasks a request can be routed by, see WithTask
+const (
+	TaskMain     = "main"
+	TaskThinking = "thinking"
+	TaskSummary  = "summary"
+)
+
+type taskKey struct{}
+
+// WithTask marks the requests made with ctx as task, a Router sends them to
+// the backend configured for it
+func WithTask(ctx context.Context, task string) context.Context {
+	return context.WithValue(ctx, taskKey{}, task)
+}
+
+// TaskFrom is the task of ctx, TaskMain when none was set
+func TaskFrom(ctx context.Context) string {
+	if task, ok := ctx.Value(taskKey{}).(string); ok && task != "" {
+		return task
+	}
+	return TaskMain
+}
+
+// Backend is one model a Router can send to
+type Backend struct {
+	Name   string // provider/model, written to log.json
+	Model  string
+	Sender Sender
+}
+
+// Router keeps the history like every client and sends each request to the
+// first backend of its chain that answers. A backend that fails with an error
+// worth failing over on, e.g. rate limited or down, hands the request to the next
+type Router struct {
+	LLM
+	Chain  []Backend            // main chain, in order
+	Routes map[string][]Backend // backends tried first for a task
+}
+
+// chain is the list of backends to try for ctx
+func (r *Router) chain(ctx context.Context) []Backend {
+	return append(append([]Backend{}, r.Routes[TaskFrom(ctx)]...), r.Chain...)
+}
+
+// failover reports whether the next backend should be asked after err: only
+// when the backend is rate limited, failing or unreachable. Anything else, e.g.
+// a cancelled run, a bad request or a too long context, stops the chain
+func failover(err error) bool {
+	var apiErr *APIError
+	var streamed *streamedError
+	if errors.As(err, &streamed) || !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Retryable()
+}
+
+// streamedError is the failure of a backend that already streamed tokens,
+// the next backend cannot take over a reply the user has partly seen
+type streamedError struct {
+	err error
+}
+
+func (e *streamedError) Error() string { return e.err.Error() }
+func (e *streamedError) Unwrap() error { return e.err }
+
+// Completion sends p as a new user message
+func (r *Router) Completion(ctx context.Context, p string, tool []tools.Tool) (LLMMessage, error) {
+	return r.Chat(ctx, []LLMMessage{UserMessage(p)}, tool)
+}
+
+func (r *Router) Chat(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return r.chat(ctx, r, msgs, tool)
+}
+
+func (r *Router) CompletionStream(ctx context.Context, p string, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return r.ChatStream(ctx, []LLMMessage{UserMessage(p)}, tool, onChunk)
+}
+
+func (r *Router) ChatStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return r.chatStream(ctx, r, msgs, tool, onChunk)
+}
+
+func (r *Router) Send(ctx context.Context, msgs []LLMMessage, tool []tools.Tool) (LLMMessage, error) {
+	return r.send(ctx, func(b Backend) (LLMMessage, error) {
+		return b.Sender.Send(ctx, msgs, tool)
+	})
+}
+
+// SendStream streams from backends that can, others deliver their reply as a
+// single chunk. Once a backend has streamed tokens there is no failing over
+func (r *Router) SendStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return r.send(ctx, func(b Backend) (LLMMessage, error) {
+		stream, ok := b.Sender.(StreamSender)
+		if !ok {
+			resp, err := b.Sender.Send(ctx, msgs, tool)
+			if err == nil && resp.Content != "" {
+				onChunk(StreamChunk{Content: resp.Content})
+			}
+			return resp, err
+		}
+		streamed := false
+		resp, err := stream.SendStream(ctx, msgs, tool, func(chunk StreamChunk) {
+			streamed = true
+			onChunk(chunk)
+		})
+		if err != nil && streamed {
+			return resp, &streamedError{err}
+		}
+		return resp, err
+	})
+}
+
+func (r *Router) send(ctx context.Context, call func(Backend) (LLMMessage, error)) (LLMMessage, error) {
+	task := TaskFrom(ctx)
+	var errs []error
+	for _, b := range r.chain(ctx) {
+		resp, err := call(b)
+		if err == nil {
+			resp.Model = b.Model
+			log.LogEvent("llm_backend", map[string]any{"task": task, "backend": b.Name})
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+		if !failover(err) {
+			break
+		}
+		log.LogEvent("llm_failover", map[string]any{
+			"task":    task,
+			"backend": b.Name,
+			"kind":    ErrorKindOf(err).String(),
+			"error":   err.Error(),
+		})
+	}
+	if len(errs) == 0 {
+		return LLMMessage{}, errors.New("router: no backend configured")
+	}
+	if len(errs) == 1 {
+		return LLMMessage{}, errs[0]
+	}
+	return LLMMessage{}, fmt.Errorf("all backends failed: %w", errors.Join(errs...))
+}
+
+// failoverRetry is the policy of a backend with another one behind it, the
+// next backend is its retry instead of a backoff that may last minutes
+var failoverRetry = RetryPolicy{MaxAttempts: 1}
+
+// newRouter builds the chain cfg, then cfg.Fallback in order, and the routes of cfg.
+// Only the last backend of the main chain retries with its own policy
+func newRouter(cfg Config) *Router {
+	backend := func(c Config, last bool) []Backend {
+		if c.Prices == nil {
+			c.Prices = cfg.Prices
+		}
+		if !last && c.Retry.MaxAttempts == 0 {
+			c.Retry = failoverRetry
+		}
+		c.Fallback, c.Routes = nil, nil
+		sender, ok := NewLLMFromConfig(c).(Sender)
+		if !ok {
+			return nil
+		}
+		return []Backend{{Name: c.Provider + "/" + c.Model, Model: c.Model, Sender: sender}}
+	}
+
+	r := &Router{
+		LLM:    cfg.LLM(),
+		Chain:  backend(cfg, len(cfg.Fallback) == 0),
+		Routes: map[string][]Backend{},
+	}
+	for i, c := range cfg.Fallback {
+		r.Chain = append(r.Chain, backend(c, i == len(cfg.Fallback)-1)...)
+	}
+	// the main chain follows the backend of a task
+	for task, c := range cfg.Routes {
+		r.Routes[task] = backend(c, false)
+	}
+	return r
+}
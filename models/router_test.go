@@ -0,0 +1,142 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answering is an openai-compatible server replying with content, or failing with status
+func answering(content string, status int, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":{"message":"failed"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"` + content + `"}}],"usage":{"prompt_tokens":1000000,"completion_tokens":0}}`))
+	}))
+}
+
+func TestRouterFailsOver(t *testing.T) {
+	var downCalls, upCalls int
+	down := answering("", http.StatusTooManyRequests, &downCalls)
+	defer down.Close()
+	up := answering("from fallback", http.StatusOK, &upCalls)
+	defer up.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai-compatible", Model: "local", BaseURL: down.URL,
+		Prices:   models.PriceTable{"gpt-4o-mini": {Input: 0.15}},
+		Fallback: []models.Config{{Provider: "openai-compatible", Model: "gpt-4o-mini", BaseURL: up.URL}},
+	})
+	resp, err := client.Completion(context.Background(), "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "from fallback" || downCalls != 1 || upCalls != 1 {
+		t.Errorf("got %q after %d/%d calls", resp.Content, downCalls, upCalls)
+	}
+	// priced as the model that answered
+	if resp.Usage == nil || resp.Usage.Cost != 0.15 {
+		t.Errorf("expected the fallback price, got %+v", resp.Usage)
+	}
+}
+
+func TestRouterFailsOverWithoutRetrying(t *testing.T) {
+	var downCalls, upCalls int
+	down := answering("", http.StatusServiceUnavailable, &downCalls)
+	defer down.Close()
+	up := answering("from fallback", http.StatusOK, &upCalls)
+	defer up.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai-compatible", Model: "local", BaseURL: down.URL,
+		Fallback: []models.Config{{Provider: "openai-compatible", Model: "other", BaseURL: up.URL}},
+	})
+	start := time.Now()
+	resp, err := client.Completion(context.Background(), "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fallback is the retry of a backend that is down
+	if resp.Content != "from fallback" || downCalls != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %q after %d calls in %s", resp.Content, downCalls, time.Since(start))
+	}
+}
+
+func TestRouterStopsAfterStreaming(t *testing.T) {
+	var upCalls int
+	// the connection drops after the first tokens
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+	}))
+	defer broken.Close()
+	up := answering("never", http.StatusOK, &upCalls)
+	defer up.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai-compatible", Model: "local", BaseURL: broken.URL,
+		Fallback: []models.Config{{Provider: "openai-compatible", Model: "other", BaseURL: up.URL}},
+	})
+	tokens := ""
+	_, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "hi", nil, func(chunk models.StreamChunk) {
+		tokens += chunk.Content
+	})
+	if models.ErrorKindOf(err) != models.ErrNetwork || strings.Contains(err.Error(), "all backends failed") || upCalls != 0 || tokens != "Hel" {
+		t.Errorf("expected the error of the streaming backend, got %v after %d calls", err, upCalls)
+	}
+}
+
+func TestRouterStopsOnBadRequest(t *testing.T) {
+	var badCalls, upCalls int
+	bad := answering("", http.StatusBadRequest, &badCalls)
+	defer bad.Close()
+	up := answering("never", http.StatusOK, &upCalls)
+	defer up.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai-compatible", Model: "local", BaseURL: bad.URL,
+		Fallback: []models.Config{{Provider: "openai-compatible", Model: "other", BaseURL: up.URL}},
+	})
+	_, err := client.Completion(context.Background(), "hi", nil)
+	var apiErr *models.APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != models.ErrBadRequest || upCalls != 0 {
+		t.Errorf("expected the bad request error without failing over, got %v after %d calls", err, upCalls)
+	}
+}
+
+func TestRouterRoutesByTask(t *testing.T) {
+	var mainCalls, cheapCalls int
+	strong := answering("strong", http.StatusOK, &mainCalls)
+	defer strong.Close()
+	cheap := answering("cheap", http.StatusOK, &cheapCalls)
+	defer cheap.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai-compatible", Model: "strong", BaseURL: strong.URL,
+		Routes: map[string]models.Config{
+			models.TaskThinking: {Provider: "openai-compatible", Model: "cheap", BaseURL: cheap.URL},
+		},
+	})
+	ctx := context.Background()
+	thought, err := client.Completion(models.WithTask(ctx, models.TaskThinking), "plan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := client.Completion(ctx, "act", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thought.Content != "cheap" || answer.Content != "strong" {
+		t.Errorf("thinking went to %q, main to %q", thought.Content, answer.Content)
+	}
+}
@@ -0,0 +1,254 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"spysearch/tools"
+	"strings"
+)
+
+// StreamChunk is a piece of a reply delivered while the model is still generating
+type StreamChunk struct {
+	Content  string
+	Thinking string // reasoning of the model, it arrives before the content
+	Done     bool
+}
+
+// StreamingCompletion is implemented by clients that can deliver tokens as they arrive.
+// The returned message is the full reply, including any tool calls
+type StreamingCompletion interface {
+	CompletionStream(ctx context.Context, p string, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error)
+	ChatStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error)
+}
+
+// StreamSender is the streaming counterpart of Sender
+type StreamSender interface {
+	SendStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error)
+}
+
+func (l *LLM) chatStream(ctx context.Context, s StreamSender, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	// a structured reply is json, streaming it would only show the raw tool call
+	if sender, ok := s.(Sender); ok && l.structured(tool) {
+		return l.chat(ctx, sender, msgs, tool)
+	}
+	if err := l.checkImages(msgs); err != nil {
+		return LLMMessage{}, err
+	}
+	l.Messages = append(l.Messages, msgs...)
+	l.trim(tool)
+	resp, err := s.SendStream(ctx, l.Messages, tool, onChunk)
+	if err != nil {
+		return LLMMessage{}, err
+	}
+	ensureToolCallIDs(&resp)
+	l.record(&resp)
+	l.Messages = append(l.Messages, resp)
+	return resp, nil
+}
+
+// Ollama streams one json object per line
+
+func (o *OllamaClient) CompletionStream(ctx context.Context, p string, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return o.ChatStream(ctx, []LLMMessage{UserMessage(p)}, tool, onChunk)
+}
+
+func (o *OllamaClient) ChatStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return o.chatStream(ctx, o, msgs, tool, onChunk)
+}
+
+func (o *OllamaClient) SendStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	res, err := o.post(ctx, o.url(ollamaBaseURL, "/api/chat"), nil, OllamaRequest{
+		Model:    o.Model,
+		Messages: msgs,
+		Stream:   true,
+		Tools:    tool,
+		Think:    o.Options.Think,
+		Options:  o.Options.ollamaOptions(),
+	})
+	if err != nil {
+		return LLMMessage{}, err
+	}
+	defer res.Body.Close()
+
+	msg := LLMMessage{Role: "assistant"}
+	var content, thinking strings.Builder
+	done := false
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var chunk OllamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != "" {
+			return LLMMessage{}, &APIError{Provider: o.providerName(""), Kind: ErrServer, Message: chunk.Error}
+		}
+		content.WriteString(chunk.Message.Content)
+		thinking.WriteString(chunk.Message.Thinking)
+		// tool calls arrive complete in a single chunk
+		msg.ToolCalls = append(msg.ToolCalls, chunk.Message.ToolCalls...)
+		onChunk(StreamChunk{Content: chunk.Message.Content, Thinking: chunk.Message.Thinking, Done: chunk.Done})
+		if chunk.Done {
+			// the final chunk carries the token counts
+			msg.Usage = newUsage(chunk.PromptEvalCount, chunk.EvalCount)
+			done = true
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return LLMMessage{}, ctx.Err()
+		}
+		return LLMMessage{}, &APIError{Provider: o.providerName(""), Kind: ErrNetwork, Err: err}
+	}
+	// a stream that ends without its done chunk is a cut reply, not a complete one
+	if !done {
+		if ctx.Err() != nil {
+			return LLMMessage{}, ctx.Err()
+		}
+		return LLMMessage{}, &APIError{Provider: o.providerName(""), Kind: ErrNetwork, Message: "stream ended before the reply was done"}
+	}
+	msg.Content, msg.Thinking = content.String(), thinking.String()
+	return msg, nil
+}
+
+// OpenAI and OpenRouter stream server sent events: "data: {...}" lines ending with "data: [DONE]"
+
+type openAIStreamChunk struct {
+	Usage *openAIUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"` // sent as an event when the provider fails mid stream
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			Reasoning        string `json:"reasoning"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func (o *OpenAIClient) CompletionStream(ctx context.Context, p string, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return o.ChatStream(ctx, []LLMMessage{UserMessage(p)}, tool, onChunk)
+}
+
+func (o *OpenAIClient) ChatStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return o.chatStream(ctx, o, msgs, tool, onChunk)
+}
+
+func (o *OpenAIClient) SendStream(ctx context.Context, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	return o.openAISendStream(ctx, o.url(openAIBaseURL, "/chat/completions"), msgs, tool, onChunk)
+}
+
+func (l *LLM) openAISendStream(ctx context.Context, endpoint string, msgs []LLMMessage, tool []tools.Tool, onChunk func(StreamChunk)) (LLMMessage, error) {
+	headers := l.bearer()
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["Accept"] = "text/event-stream"
+	res, err := l.post(ctx, endpoint, headers, OpenAIRequest{
+		Model:          l.Model,
+		Messages:       toOpenAIMessages(msgs),
+		Stream:         true,
+		StreamOptions:  &openAIStreamOptions{IncludeUsage: true},
+		Tools:          tool,
+		openAISampling: l.Options.openAI(),
+	})
+	if err != nil {
+		return LLMMessage{}, err
+	}
+	defer res.Body.Close()
+
+	msg := LLMMessage{Role: "assistant"}
+	var content, thinking strings.Builder
+	// tool call arguments arrive as string fragments keyed by index
+	calls := []ToolCall{}
+	args := []string{}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != nil {
+			return LLMMessage{}, &APIError{Provider: l.providerName(endpoint), Kind: ErrServer, Message: chunk.Error.Message}
+		}
+		// with include_usage the last chunk has no choices, only usage
+		if chunk.Usage != nil {
+			msg.Usage = newUsage(chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens)
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		for _, tc := range delta.ToolCalls {
+			for len(calls) <= tc.Index {
+				calls = append(calls, ToolCall{Type: "function"})
+				args = append(args, "")
+			}
+			if tc.ID != "" {
+				calls[tc.Index].ID = tc.ID
+			}
+			if tc.Function.Name != "" {
+				calls[tc.Index].Function.Name += tc.Function.Name
+			}
+			args[tc.Index] += tc.Function.Arguments
+		}
+		if reasoning := delta.Reasoning + delta.ReasoningContent; reasoning != "" {
+			thinking.WriteString(reasoning)
+			onChunk(StreamChunk{Thinking: reasoning})
+		}
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			onChunk(StreamChunk{Content: delta.Content})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return LLMMessage{}, ctx.Err()
+		}
+		return LLMMessage{}, &APIError{Provider: l.providerName(endpoint), Kind: ErrNetwork, Err: err}
+	}
+	onChunk(StreamChunk{Done: true})
+
+	for i := range calls {
+		calls[i].Function.Arguments = map[string]any{}
+		if raw := strings.TrimSpace(args[i]); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &calls[i].Function.Arguments); err != nil {
+				calls[i].Function.Arguments = map[string]any{}
+				calls[i].Function.ArgumentsError = fmt.Sprintf("invalid arguments %s: %v", raw, err)
+			}
+		}
+	}
+	msg.Content, msg.Thinking = content.String(), thinking.String()
+	if len(calls) > 0 {
+		msg.ToolCalls = calls
+	}
+	return msg, nil
+}
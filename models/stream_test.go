@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"spysearch/tools"
+	"strings"
+	"testing"
+)
+
+func TestOllamaStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["stream"] != true {
+			t.Error("expected a streaming request")
+		}
+		// the final chunk carries no tool_calls, which used to panic
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Hello"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":" world"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"done","arguments":{"message":"ok"}}}]},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true}`)
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL})
+	tokens := []string{}
+	resp, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "hi", []tools.Tool{tools.NewDoneTool().Tool}, func(chunk models.StreamChunk) {
+		tokens = append(tokens, chunk.Content)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "Hello world" || tokens[0] != "Hello" {
+		t.Errorf("unexpected content %q, tokens %q", resp.Content, tokens)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].ID == "" {
+		t.Errorf("expected one tool call with an id, got %+v", resp.ToolCalls)
+	}
+}
+
+func TestOpenAICompatibleStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		chunks := []string{
+			`{"choices":[{"delta":{"role":"assistant","content":"Running"}}]}`,
+			`{"choices":[{"delta":{"content":" ls"}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"bash","arguments":""}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"comm"}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"and\":\"ls\"}"}}]}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		}
+		for _, c := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openai-compatible", Model: "local", BaseURL: server.URL + "/v1"})
+	var got strings.Builder
+	resp, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "list files", []tools.Tool{tools.NewBashTool().Tool}, func(chunk models.StreamChunk) {
+		got.WriteString(chunk.Content)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "Running ls" || resp.Content != "Running ls" {
+		t.Errorf("unexpected content %q", got.String())
+	}
+	if len(resp.ToolCalls) != 1 {
+		t.Fatalf("expected one tool call, got %+v", resp.ToolCalls)
+	}
+	call := resp.ToolCalls[0]
+	if call.ID != "call_1" || call.Function.Name != "bash" || call.Function.Arguments["command"] != "ls" {
+		t.Errorf("unexpected tool call %+v", call)
+	}
+}
+
+func TestStreamFailures(t *testing.T) {
+	cases := []struct {
+		provider string
+		body     string
+		kind     models.ErrorKind
+		message  string
+	}{
+		// the server went away before the done chunk
+		{"ollama", `{"message":{"role":"assistant","content":"Hel"},"done":false}` + "\n", models.ErrNetwork, "before the reply was done"},
+		{"openai-compatible", "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\ndata: {\"error\":{\"message\":\"upstream overloaded\"}}\n\n", models.ErrServer, "upstream overloaded"},
+	}
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, c.body)
+		}))
+		client := models.NewLLMFromConfig(models.Config{Provider: c.provider, Model: "m", BaseURL: server.URL})
+		_, err := client.(models.StreamingCompletion).CompletionStream(context.Background(), "hi", nil, func(models.StreamChunk) {})
+		server.Close()
+		var apiErr *models.APIError
+		if !errors.As(err, &apiErr) || apiErr.Kind != c.kind || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected an APIError about %q, got %v", c.provider, c.message, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"encoding/json"
+	"spysearch/tools"
+	"strings"
+)
+
+// Structured output is for models without native tool calling: instead of
+// sending the tools, the reply is constrained to a json object naming a tool
+// and its arguments. Ollama takes the schema as `format`, openai compatible
+// servers as a json_schema response_format. The reply is turned back into a
+// ToolCall, so the agent cannot tell the difference
+
+// structured reports whether a request with tool uses structured output
+func (l *LLM) structured(tool []tools.Tool) bool {
+	return l.Structured && len(tool) > 0
+}
+
+// ToolCallSchema is the json schema of a call to one of tool:
+// {"name": "<tool name>", "arguments": {...}}
+func ToolCallSchema(tool []tools.Tool) map[string]any {
+	names := []string{}
+	arguments := []any{}
+	for _, t := range tool {
+		names = append(names, t.ToolFunction.Name)
+		arguments = append(arguments, parameterSchema(t.ToolFunction.Parameters))
+	}
+	args := map[string]any{"anyOf": arguments}
+	if len(arguments) == 1 {
+		args = arguments[0].(map[string]any)
+	}
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":      map[string]any{"type": "string", "enum": names},
+			"arguments": args,
+		},
+		"required": []string{"name", "arguments"},
+	}
+}
+
+func parameterSchema(p tools.ToolParameter) map[string]any {
+	properties := map[string]any{}
+	for name, prop := range p.Properties {
+		schema := map[string]any{"type": prop.Type}
+		if prop.Description != "" {
+			schema["description"] = prop.Description
+		}
+		properties[name] = schema
+	}
+	required := p.Required
+	if required == nil {
+		required = []string{}
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+// structuredMessages tells the model about the tools it can no longer see
+// natively. The note is added to the system message of the request, and past
+// calls and their results are rewritten the way the model wrote and reads
+// them: json content and user messages. LLM.Messages is left as it is
+func structuredMessages(msgs []LLMMessage, tool []tools.Tool) []LLMMessage {
+	defs, _ := json.Marshal(tool)
+	note := "Answer with a single json object {\"name\": <tool name>, \"arguments\": {...}} calling one of these tools:\n" + string(defs)
+
+	out := make([]LLMMessage, 0, len(msgs)+1)
+	for _, m := range msgs {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			calls := []string{}
+			for _, c := range m.ToolCalls {
+				data, _ := json.Marshal(c.Function)
+				calls = append(calls, string(data))
+			}
+			m.Content = strings.TrimSpace(m.Content + "\n" + strings.Join(calls, "\n"))
+			m.ToolCalls = nil
+		case m.Role == "tool":
+			m = LLMMessage{Role: "user", Content: "Result of " + m.ToolName + ":\n" + m.Content}
+		}
+		out = append(out, m)
+	}
+	if len(out) > 0 && out[0].Role == "system" {
+		out[0].Content += "\n\n" + note
+		return out
+	}
+	return append([]LLMMessage{{Role: "system", Content: note}}, out...)
+}
+
+// parseStructured turns a json tool call in the content of msg into a ToolCall,
+// msg is left alone when the content is not one
+func parseStructured(msg *LLMMessage) {
+	var call ToolCallFunction
+	content := strings.TrimSpace(msg.Content)
+	if err := json.Unmarshal([]byte(content), &call); err != nil || call.Name == "" {
+		return
+	}
+	if call.Arguments == nil {
+		call.Arguments = map[string]any{}
+	}
+	msg.ToolCalls = append(msg.ToolCalls, ToolCall{Type: "function", Function: call})
+	msg.Content = ""
+}
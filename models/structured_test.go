@@ -0,0 +1,112 @@
+package models_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"spysearch/tools"
+	"strings"
+	"testing"
+)
+
+func TestStructuredOllama(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Tools    []any               `json:"tools"`
+			Format   map[string]any      `json:"format"`
+			Messages []models.LLMMessage `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Tools != nil || req.Format["type"] != "object" {
+			t.Errorf("expected a format schema instead of tools, got %+v", req)
+		}
+		if req.Messages[0].Role != "system" || !strings.Contains(req.Messages[0].Content, `"name":"bash"`) {
+			t.Errorf("expected the tools to be described in the system message, got %+v", req.Messages)
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"{\"name\": \"bash\", \"arguments\": {\"command\": \"ls\"}}"},"done":true}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL, Structured: true})
+	client.SetSystemPrompt("You are an agent.")
+	resp, err := client.Completion(context.Background(), "list files", []tools.Tool{tools.NewBashTool().Tool, tools.NewDoneTool().Tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "" || len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Arguments["command"] != "ls" || resp.ToolCalls[0].ID == "" {
+		t.Errorf("expected a bash tool call, got %+v", resp)
+	}
+}
+
+func TestStructuredOpenAI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		format, _ := req["response_format"].(map[string]any)
+		if req["tools"] != nil || format["type"] != "json_schema" {
+			t.Errorf("expected a json_schema response format instead of tools, got %v", req)
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"{\"name\":\"done\",\"arguments\":{\"message\":\"ok\"}}"}}]}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "openai-compatible", Model: "local", BaseURL: server.URL, Structured: true})
+	resp, err := client.Completion(context.Background(), "finish", []tools.Tool{tools.NewDoneTool().Tool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Name != "done" {
+		t.Errorf("expected a done tool call, got %+v", resp)
+	}
+}
+
+func TestToolCallSchema(t *testing.T) {
+	schema := models.ToolCallSchema([]tools.Tool{tools.NewBashTool().Tool, tools.NewThinkingTool().Tool})
+	props := schema["properties"].(map[string]any)
+	names := props["name"].(map[string]any)["enum"].([]string)
+	if len(names) != 2 || names[0] != "bash" || names[1] != "thinking" {
+		t.Errorf("unexpected names %v", names)
+	}
+	args := props["arguments"].(map[string]any)["anyOf"].([]any)
+	bash := args[0].(map[string]any)
+	if bash["required"].([]string)[0] != "command" {
+		t.Errorf("unexpected bash schema %v", bash)
+	}
+}
+
+func TestStructuredHistory(t *testing.T) {
+	var requests []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		w.Write([]byte(`{"message":{"role":"assistant","content":"{\"name\": \"bash\", \"arguments\": {\"command\": \"ls\"}}"},"done":true}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{Provider: "ollama", Model: "qwen2.5-coder:3b", BaseURL: server.URL, Structured: true})
+	bash := []tools.Tool{tools.NewBashTool().Tool}
+	first, err := client.Completion(context.Background(), "list files", bash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Chat(context.Background(), []models.LLMMessage{models.ToolMessage(first.ToolCalls[0], "main.go")}, bash); err != nil {
+		t.Fatal(err)
+	}
+
+	// the model reads its call as the json it wrote and the result as a user message
+	msgs := requests[1]["messages"].([]any)
+	call, result := msgs[len(msgs)-2].(map[string]any), msgs[len(msgs)-1].(map[string]any)
+	if call["role"] != "assistant" || call["tool_calls"] != nil || !strings.Contains(call["content"].(string), `"name":"bash"`) {
+		t.Errorf("unexpected call %v", call)
+	}
+	if result["role"] != "user" || !strings.Contains(result["content"].(string), "main.go") {
+		t.Errorf("unexpected result %v", result)
+	}
+	// the history keeps the native form
+	if len(client.(*models.OllamaClient).Messages[1].ToolCalls) != 1 {
+		t.Error("the history was rewritten")
+	}
+}
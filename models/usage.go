@@ -0,0 +1,73 @@
+package models
+
+import "strings"
+
+// Usage is the token accounting of one call, or the sum of several
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"` // USD, 0 when the model has no price
+}
+
+func (u *Usage) Add(o Usage) {
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.TotalTokens += o.TotalTokens
+	u.Cost += o.Cost
+}
+
+// Price of a model in USD per million tokens
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// PriceTable maps model names to prices, a key also matches dated variants
+// of the model, e.g. "gpt-4o" prices "gpt-4o-2024-08-06"
+type PriceTable map[string]Price
+
+func (t PriceTable) Lookup(model string) (Price, bool) {
+	if p, ok := t[model]; ok {
+		return p, true
+	}
+	best := ""
+	for name := range t {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return t[best], true
+}
+
+func (t PriceTable) Cost(model string, u Usage) float64 {
+	p, ok := t.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return (float64(u.PromptTokens)*p.Input + float64(u.CompletionTokens)*p.Output) / 1e6
+}
+
+func newUsage(prompt, completion int) *Usage {
+	return &Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
+
+// record prices the usage of resp and adds it to the client total
+func (l *LLM) record(resp *LLMMessage) {
+	if resp.Usage == nil {
+		return
+	}
+	model := l.Model
+	if resp.Model != "" {
+		model = resp.Model
+	}
+	resp.Usage.Cost = l.Prices.Cost(model, *resp.Usage)
+	l.Usage.Add(*resp.Usage)
+}
@@ -0,0 +1,51 @@
+package models_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"spysearch/models"
+	"testing"
+)
+
+func TestUsageAndCost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`))
+	}))
+	defer server.Close()
+
+	client := models.NewLLMFromConfig(models.Config{
+		Provider: "openai",
+		Model:    "gpt-4o-2024-08-06",
+		BaseURL:  server.URL,
+		Prices:   models.PriceTable{"gpt-4o": {Input: 2.5, Output: 10}},
+	}).(*models.OpenAIClient)
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Completion(context.Background(), "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Usage == nil || resp.Usage.TotalTokens != 1500 {
+			t.Fatalf("expected usage on the reply, got %+v", resp.Usage)
+		}
+		// 1000 * 2.5 / 1e6 + 500 * 10 / 1e6
+		if math.Abs(resp.Usage.Cost-0.0075) > 1e-9 {
+			t.Errorf("unexpected cost %f", resp.Usage.Cost)
+		}
+	}
+	if client.Usage.TotalTokens != 3000 || math.Abs(client.Usage.Cost-0.015) > 1e-9 {
+		t.Errorf("unexpected client total %+v", client.Usage)
+	}
+}
+
+func TestPriceLookup(t *testing.T) {
+	prices := models.PriceTable{"gpt-4o": {Input: 2.5}, "gpt-4o-mini": {Input: 0.15}}
+	if p, _ := prices.Lookup("gpt-4o-mini-2024-07-18"); p.Input != 0.15 {
+		t.Errorf("expected the longest matching prefix, got %+v", p)
+	}
+	if _, ok := prices.Lookup("qwen2.5-coder:3b"); ok {
+		t.Error("unpriced models should not match")
+	}
+}
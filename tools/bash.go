@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"log/slog"
 	"os/exec"
@@ -61,13 +62,13 @@ func NewBashTool() BashTool {
 	}
 }
 
-func bashExecutor(args map[string]any) (ToolExecutionResult, error) {
+func bashExecutor(ctx context.Context, args map[string]any) (ToolExecutionResult, error) {
 	bashArgs, err := bashParseArgs(args)
 	if err != nil {
 		return ToolExecutionResult{}, nil
 	}
 
-	cmd := exec.Command(bashArgs.Command)
+	cmd := exec.CommandContext(ctx, bashArgs.Command)
 	if err := cmd.Run(); err != nil {
 		return ToolExecutionResult{
 			Result:    "Error " + err.Error(),
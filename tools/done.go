@@ -1,6 +1,9 @@
 package tools
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+)
 
 type DoneTool struct {
 	Tool
@@ -36,8 +39,10 @@ func NewDoneTool() DoneTool {
 	}
 }
 
-func doneExecutor(args map[string]any) (ToolExecutionResult, error) {
-	var msg struct{ Message string `json:"message"` }
+func doneExecutor(ctx context.Context, args map[string]any) (ToolExecutionResult, error) {
+	var msg struct {
+		Message string `json:"message"`
+	}
 	data, _ := json.Marshal(args)
 	json.Unmarshal(data, &msg)
 	return ToolExecutionResult{
@@ -45,4 +50,4 @@ func doneExecutor(args map[string]any) (ToolExecutionResult, error) {
 		Error:     nil,
 		ErrorCode: 0,
 	}, nil
-} 
\ No newline at end of file
+}
@@ -2,6 +2,7 @@ package tools
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -55,9 +56,9 @@ func (s *InMemoryStore) LoadAll() ([]MemoryEntry, error) {
 	return s.data, nil
 }
 
-type SummarizerFunc func(entries []MemoryEntry) (string, error)
+type SummarizerFunc func(ctx context.Context, entries []MemoryEntry) (string, error)
 
-func BasicSummarizer(entries []MemoryEntry) (string, error) {
+func BasicSummarizer(ctx context.Context, entries []MemoryEntry) (string, error) {
 	var sb strings.Builder
 	sb.WriteString("🧠 Summarized Conversation:\n\n")
 	for _, e := range entries {
@@ -72,7 +73,7 @@ type OpenAISummarizer struct {
 	APIHost string // usually "https://api.openai.com/v1"
 }
 
-func (s *OpenAISummarizer) Summarize(entries []MemoryEntry) (string, error) {
+func (s *OpenAISummarizer) Summarize(ctx context.Context, entries []MemoryEntry) (string, error) {
 	var input strings.Builder
 	for _, e := range entries {
 		input.WriteString(fmt.Sprintf("User: %s\nAssistant: %s\n\n", e.Prompt, e.Response))
@@ -88,7 +89,7 @@ func (s *OpenAISummarizer) Summarize(entries []MemoryEntry) (string, error) {
 	}
 	bodyBytes, _ := json.Marshal(reqBody)
 
-	req, err := http.NewRequest("POST", s.APIHost+"/chat/completions", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.APIHost+"/chat/completions", bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		return "", err
 	}
@@ -163,7 +164,7 @@ func NewMemoryTool(store MemoryStore, summarizer SummarizerFunc) MemoryTool {
 }
 
 // memoryExecutor summarizes the prompt/response history
-func (m MemoryTool) memoryExecutor(args map[string]any) (ToolExecutionResult, error) {
+func (m MemoryTool) memoryExecutor(ctx context.Context, args map[string]any) (ToolExecutionResult, error) {
 	memArgs, result, err := memoryParseArgs(args)
 	if err != nil {
 		return result, err
@@ -183,7 +184,7 @@ func (m MemoryTool) memoryExecutor(args map[string]any) (ToolExecutionResult, er
 		return ToolExecutionResult{Error: err, ErrorCode: 5}, err
 	}
 
-	summary, err := m.summarizer(all)
+	summary, err := m.summarizer(ctx, all)
 	if err != nil {
 		return ToolExecutionResult{Error: err, ErrorCode: 6}, err
 	}
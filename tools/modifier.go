@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -77,7 +78,7 @@ func NewModifierTool() ModifyTool {
 	}
 }
 
-func modifierExecutor(args map[string]any) (ToolExecutionResult, error) {
+func modifierExecutor(ctx context.Context, args map[string]any) (ToolExecutionResult, error) {
 	var margs modifyArgs
 	data, err := json.Marshal(args)
 	if err != nil {
@@ -2,6 +2,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"log/slog"
 )
@@ -12,8 +13,8 @@ type ThinkingTool struct {
 }
 
 // convert this to string template
-var thinkingPrompt = `In order to hnadler complex tasks you would like to think deeply and figure out the root of the problem. Don't hesitate to think longer if you think it 
-is necesssary. You are given the following problem statement. 
+var thinkingPrompt = `In order to handle complex tasks you would like to think deeply and figure out the root of the problem. Don't hesitate to think longer if you think it 
+is necessary. Call this tool with your own reasoning before acting and whenever a result changes your plan, nothing is executed and the user sees the content.
 `
 
 func NewThinkingTool() ThinkingTool {
@@ -23,7 +24,7 @@ func NewThinkingTool() ThinkingTool {
 	thinkingProperties := map[string]ToolProperty{}
 
 	tkingstep := ToolProperty{
-		Type:        "Interger",
+		Type:        "integer",
 		Description: "Number of step that you think it takes to solve this problem. Minimial would be 1 and Maximum would be 25. Don't hesitate to make a large number if you think this task is difficult",
 	}
 
@@ -69,7 +70,7 @@ func NewThinkingTool() ThinkingTool {
 }
 
 // here can we actually not using any
-func thinkingExecutor(args map[string]any) (ToolExecutionResult, error) {
+func thinkingExecutor(ctx context.Context, args map[string]any) (ToolExecutionResult, error) {
 
 	data, err := parsethinkingArgs(args)
 
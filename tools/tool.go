@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"regexp"
@@ -8,9 +9,9 @@ import (
 
 // here we provides an abstraction type of tool
 type Tool struct {
-	ToolFunction ToolFunction                                           `json:"function"`
-	Type         string                                                 `json:"type"`
-	Execute      func(args map[string]any) (ToolExecutionResult, error) `json:"-"` // maybe an interface is not a good option
+	ToolFunction ToolFunction                                                                `json:"function"`
+	Type         string                                                                      `json:"type"`
+	Execute      func(ctx context.Context, args map[string]any) (ToolExecutionResult, error) `json:"-"` // maybe an interface is not a good option
 }
 
 type ToolFunction struct {
@@ -1,33 +1,35 @@
 package tools_test
 
 import (
-	"log/slog"
-	"os"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"spysearch/tools"
+	"strings"
 	"testing"
 )
 
 func TestParseArgs(t *testing.T) {
-	tk := tools.ThinkingTool{}
+	tk := tools.NewThinkingTool()
 
 	mock_data := map[string]any{}
 
-	mock_data["thinkginstep"] = 10
+	mock_data["thinkingstep"] = 10
 	mock_data["rethink"] = false
 	mock_data["content"] = "this is a test content"
 
-	_, err := tk.Execute(mock_data)
-
+	result, err := tk.Execute(context.Background(), mock_data)
 	if err != nil {
-		slog.Error(err.Error())
+		t.Fatal(err)
+	}
+	if result.Result != "this is a test content" {
+		t.Errorf("unexpected result %q", result.Result)
 	}
 }
 
 func TestMemoryTool(t *testing.T) {
-	// Test BasicSummarizer
-	store := &tools.InMemoryStore{}
-	tool := tools.NewMemoryTool(store, tools.BasicSummarizer)
-	tool.Execute(map[string]any{
+	history := map[string]any{
 		"history": []tools.MemoryEntry{
 			{
 				ID:        "1",
@@ -36,24 +38,49 @@ func TestMemoryTool(t *testing.T) {
 				Timestamp: "2025-07-19T15:00:00Z",
 			},
 		},
-	})
+	}
+
+	// Test BasicSummarizer
+	store := &tools.InMemoryStore{}
+	tool := tools.NewMemoryTool(store, tools.BasicSummarizer)
+	result, err := tool.Execute(context.Background(), history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Result, "What is a goroutine?") {
+		t.Errorf("unexpected summary %q", result.Result)
+	}
+
+	// Test OpenAISummarizer against a stand-in server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" || r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("unexpected request %s %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Messages) != 2 || !strings.Contains(req.Messages[1].Content, "lightweight thread") {
+			t.Errorf("history missing from request %+v", req)
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"Goroutines are lightweight threads."}}]}`))
+	}))
+	defer server.Close()
 
-	// Test OpenAISummarizer
 	store = &tools.InMemoryStore{}
 	summarizer := &tools.OpenAISummarizer{
-		APIKey:  os.Getenv("OPENAI_API_KEY"),
+		APIKey:  "test-key",
 		Model:   "gpt-4",
-		APIHost: "https://api.openai.com/v1",
+		APIHost: server.URL,
 	}
 	tool = tools.NewMemoryTool(store, summarizer.Summarize)
-	tool.Execute(map[string]any{
-		"history": []tools.MemoryEntry{
-			{
-				ID:        "1",
-				Prompt:    "What is a goroutine?",
-				Response:  "It's a lightweight thread in Go.",
-				Timestamp: "2025-07-19T15:00:00Z",
-			},
-		},
-	})
+	result, err = tool.Execute(context.Background(), history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Result != "Goroutines are lightweight threads." {
+		t.Errorf("unexpected summary %q", result.Result)
+	}
 }